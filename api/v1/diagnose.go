@@ -0,0 +1,321 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// defaultDiagnoseEndpoint is the endpoint used to check internet connectivity
+	// if none is given in the request.
+	defaultDiagnoseEndpoint = "connectivitycheck.gstatic.com:80"
+	// diagnosePath is requested from the endpoint, which must respond with 204 No Content.
+	// Any other response, e.g. a redirect, means that something like a captive portal intercepts web requests.
+	diagnosePath = "/generate_204"
+	// diagnoseStepTimeout is the maximum amount of time any single step may take.
+	diagnoseStepTimeout = 5 * time.Second
+	resolvConf          = "/etc/resolv.conf"
+)
+
+type diagnoseStepStatus string
+
+const (
+	passedDiagnoseStepStatus  diagnoseStepStatus = "passed"
+	failedDiagnoseStepStatus  diagnoseStepStatus = "failed"
+	skippedDiagnoseStepStatus diagnoseStepStatus = "skipped"
+	pendingDiagnoseStepStatus diagnoseStepStatus = "pending"
+)
+
+type diagnoseStepResponse struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Status      diagnoseStepStatus `json:"status"`
+	// Message is a human-friendly explanation of the result.
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type diagnoseResponse struct {
+	Steps []*diagnoseStepResponse `json:"steps"`
+	// Failed is the name of the first step that failed.
+	// It is empty if all steps passed.
+	Failed string `json:"failed,omitempty"`
+	// Message is a human-friendly explanation of the first failure.
+	Message string `json:"message,omitempty"`
+}
+
+// diagnosis holds the state that is discovered by earlier steps
+// and needed by later ones.
+type diagnosis struct {
+	iface    string
+	endpoint string
+	link     netlink.Link
+	gateway  net.IP
+}
+
+// errSkipDiagnoseStep is returned by a step that does not apply to the device.
+var errSkipDiagnoseStep = errors.New("step does not apply")
+
+type diagnoseStep struct {
+	name        string
+	description string
+	// run returns a human-friendly message explaining the failure and the underlying error.
+	run func(context.Context, *diagnosis) (string, error)
+}
+
+var diagnoseSteps = []diagnoseStep{
+	{
+		name:        "link",
+		description: "Interface is up",
+		run: func(_ context.Context, d *diagnosis) (string, error) {
+			li, err := netlink.LinkByName(d.iface)
+			if err != nil {
+				return fmt.Sprintf("The network interface %s could not be found. Make sure the wireless hardware is supported.", d.iface), err
+			}
+			d.link = li
+			// Some drivers never report an operational state,
+			// in which case the administrative state is used.
+			if s := li.Attrs().OperState; s != netlink.OperUp && !(s == netlink.OperUnknown && li.Attrs().Flags&net.FlagUp != 0) {
+				return fmt.Sprintf("The network interface %s is %s.", d.iface, s), fmt.Errorf("interface is %s", s)
+			}
+			return "", nil
+		},
+	},
+	{
+		name:        "associated",
+		description: "Connected to wireless network",
+		run: func(_ context.Context, d *diagnosis) (string, error) {
+			wr, err := wirelessStatus(d.link.Attrs().Index)
+			if err == errNotAssociated {
+				return "The device is not connected to a wireless network. Check the network name and password.", err
+			}
+			if err != nil {
+				// The interface is not wireless.
+				return "", errSkipDiagnoseStep
+			}
+			return fmt.Sprintf("Connected to %s at %d dBm.", wr.SSID, wr.Signal), nil
+		},
+	},
+	{
+		name:        "address",
+		description: "Obtained an IP address",
+		run: func(_ context.Context, d *diagnosis) (string, error) {
+			addrs, err := netlink.AddrList(d.link, netlink.FAMILY_ALL)
+			if err != nil {
+				return "The addresses of the network interface could not be listed.", err
+			}
+			for _, a := range addrs {
+				if a.IP.IsGlobalUnicast() {
+					return fmt.Sprintf("Using address %s.", a.IPNet), nil
+				}
+			}
+			return "The device did not receive an IP address. Check that the network has a working DHCP server.", errors.New("no global unicast address")
+		},
+	},
+	{
+		name:        "route",
+		description: "Has a default route",
+		run: func(_ context.Context, d *diagnosis) (string, error) {
+			gw, err := defaultGateway(d.link)
+			if err != nil {
+				return "The routes of the network interface could not be listed.", err
+			}
+			if gw == nil {
+				return "The device does not have a default route. Check that the DHCP server advertises a router.", errors.New("no default route")
+			}
+			d.gateway = gw
+			return fmt.Sprintf("Using gateway %s.", gw), nil
+		},
+	},
+	{
+		name:        "gateway",
+		description: "Gateway is reachable",
+		run: func(ctx context.Context, d *diagnosis) (string, error) {
+			if err := exec.CommandContext(ctx, "ping", "-c", "1", "-w", "1", d.gateway.String()).Run(); err != nil {
+				return fmt.Sprintf("The gateway %s did not respond. The router may be down or blocking the device.", d.gateway), err
+			}
+			return "", nil
+		},
+	},
+	{
+		name:        "dns-servers",
+		description: "DNS servers are configured",
+		run: func(_ context.Context, _ *diagnosis) (string, error) {
+			servers, err := nameservers()
+			if err != nil {
+				return "The DNS configuration could not be read.", err
+			}
+			if len(servers) == 0 {
+				return "No DNS servers are configured. Check that the DHCP server advertises DNS servers.", errors.New("no nameservers")
+			}
+			return fmt.Sprintf("Using DNS servers %s.", strings.Join(servers, ", ")), nil
+		},
+	},
+	{
+		name:        "dns",
+		description: "DNS names can be resolved",
+		run: func(ctx context.Context, d *diagnosis) (string, error) {
+			h, _, err := net.SplitHostPort(d.endpoint)
+			if err != nil {
+				return "The endpoint used to check connectivity is invalid.", err
+			}
+			hosts, err := net.DefaultResolver.LookupHost(ctx, h)
+			if err == nil && len(hosts) == 0 {
+				err = errors.New("found no addresses for host")
+			}
+			if err != nil {
+				return fmt.Sprintf("The name %s could not be resolved. The DNS servers may be unreachable.", h), err
+			}
+			return "", nil
+		},
+	},
+	{
+		name:        "tcp",
+		description: "Internet is reachable",
+		run: func(ctx context.Context, d *diagnosis) (string, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", d.endpoint)
+			if err != nil {
+				return fmt.Sprintf("Could not connect to %s. The network may not have internet access or may block outgoing connections.", d.endpoint), err
+			}
+			conn.Close()
+			return "", nil
+		},
+	},
+	{
+		name:        "http",
+		description: "Web requests succeed",
+		run: func(ctx context.Context, d *diagnosis) (string, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+d.endpoint+diagnosePath, nil)
+			if err != nil {
+				return "The endpoint used to check connectivity is invalid.", err
+			}
+			// Captive portals answer every request with a redirect to their login page,
+			// so redirects must not be followed.
+			c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			res, err := c.Do(req)
+			if err != nil {
+				return fmt.Sprintf("A web request to %s failed. The network may not have internet access.", d.endpoint), err
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNoContent {
+				msg := fmt.Sprintf("A web request to %s was answered with %s instead of %d %s. The network may require signing in through a captive portal.", d.endpoint, res.Status, http.StatusNoContent, http.StatusText(http.StatusNoContent))
+				if loc := res.Header.Get("Location"); loc != "" {
+					msg = fmt.Sprintf("A web request to %s was redirected to %s. The network may require signing in through a captive portal.", d.endpoint, loc)
+				}
+				return msg, fmt.Errorf("unexpected response status %s", res.Status)
+			}
+			return "", nil
+		},
+	},
+}
+
+// nameservers returns the DNS servers configured in the system's resolver configuration.
+func nameservers() ([]string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, s.Err()
+}
+
+// diagnose runs the diagnosis steps in order and stops at the first failure.
+// All steps after the failure are reported as pending.
+func diagnose(ctx context.Context, iface, endpoint string) *diagnoseResponse {
+	d := &diagnosis{iface: iface, endpoint: endpoint}
+	dr := &diagnoseResponse{Steps: make([]*diagnoseStepResponse, 0, len(diagnoseSteps))}
+	for _, s := range diagnoseSteps {
+		sr := &diagnoseStepResponse{
+			Name:        s.name,
+			Description: s.description,
+			Status:      pendingDiagnoseStepStatus,
+		}
+		dr.Steps = append(dr.Steps, sr)
+		if dr.Failed != "" {
+			continue
+		}
+		sctx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+		msg, err := s.run(sctx, d)
+		cancel()
+		switch {
+		case err == errSkipDiagnoseStep:
+			sr.Status = skippedDiagnoseStepStatus
+		case err != nil:
+			sr.Status = failedDiagnoseStepStatus
+			sr.Message = msg
+			sr.Error = err.Error()
+			dr.Failed = s.name
+			dr.Message = msg
+		default:
+			sr.Status = passedDiagnoseStepStatus
+			sr.Message = msg
+		}
+	}
+	return dr
+}
+
+func newDiagnoseHandler(l log.Logger, iface string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoint := r.FormValue("endpoint")
+		if endpoint == "" {
+			endpoint = defaultDiagnoseEndpoint
+		}
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			msg := "failed to parse endpoint"
+			level.Warn(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusBadRequest)
+			return
+		}
+		dr := diagnose(r.Context(), iface, endpoint)
+		if dr.Failed != "" {
+			level.Info(l).Log("msg", "network diagnosis failed", "step", dr.Failed, "reason", dr.Message)
+		}
+		buf, err := json.Marshal(dr)
+		if err != nil {
+			msg := "failed to marshal response"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// decryptSecrets replaces the given secret values with their decrypted form.
+// Secret values are encrypted by clients with RSA-OAEP using SHA-256 and the published key.
+// Since RSA-OAEP can only encrypt short messages, long values are split into chunks
+// that are encrypted individually, base64-encoded, and joined with periods.
+func decryptSecrets(key *rsa.PrivateKey, secrets []string, values map[string]string) error {
+	for _, name := range secrets {
+		v, ok := values[name]
+		if !ok {
+			continue
+		}
+		d, err := decryptValue(key, v)
+		if err != nil {
+			return &ValueError{Name: name, Err: fmt.Errorf("must be encrypted with the published key: %w", err)}
+		}
+		values[name] = d
+	}
+	return nil
+}
+
+func decryptValue(key *rsa.PrivateKey, value string) (string, error) {
+	var b strings.Builder
+	for _, chunk := range strings.Split(value, ".") {
+		ciphertext, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return "", err
+		}
+		plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext, nil)
+		if err != nil {
+			return "", err
+		}
+		b.Write(plaintext)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type identityResponse struct {
+	// PublicKey is the PEM-encoded public key of the device.
+	PublicKey string `json:"publicKey"`
+	// Fingerprint is the hex-encoded SHA-256 digest of the DER-encoded public key.
+	Fingerprint string `json:"fingerprint"`
+}
+
+func newIdentityHandler(l log.Logger, publicKey crypto.PublicKey) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			msg := "failed to marshal public key"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		sum := sha256.Sum256(der)
+		buf, err := json.Marshal(identityResponse{
+			PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			Fingerprint: hex.EncodeToString(sum[:]),
+		})
+		if err != nil {
+			msg := "failed to marshal identity"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
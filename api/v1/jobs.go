@@ -0,0 +1,348 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// jobsHistory is the number of finished jobs that are kept for clients to inspect.
+	jobsHistory = 10
+	// maxActionOutput is the number of bytes of output that are captured per action.
+	maxActionOutput = 64 << 10
+)
+
+// Action is a named step of onboarding.
+type Action struct {
+	Name string
+	// Deferred actions are disruptive, e.g. because they restart the network or reboot the device.
+	// They run after all other actions have succeeded and clients have had time
+	// to receive the final status of the job.
+	Deferred bool
+	// Run performs the action with the submitted values.
+	// Any output of the action, e.g. of a command, is written to out.
+	Run func(ctx context.Context, values map[string]string, out io.Writer) error
+}
+
+// ActionState is the state of an action in an onboarding job.
+type ActionState string
+
+const (
+	// ActionStatePending means that the action has not started yet.
+	ActionStatePending ActionState = "pending"
+	// ActionStateRunning means that the action is running.
+	ActionStateRunning ActionState = "running"
+	// ActionStateSucceeded means that the action succeeded.
+	ActionStateSucceeded ActionState = "succeeded"
+	// ActionStateFailed means that the action failed.
+	ActionStateFailed ActionState = "failed"
+	// ActionStateSkipped means that the action was not run because an earlier action failed
+	// or the job was cancelled.
+	ActionStateSkipped ActionState = "skipped"
+)
+
+// ActionStatus is the status of an action in an onboarding job.
+type ActionStatus struct {
+	Name  string      `json:"name"`
+	State ActionState `json:"state"`
+	// Deferred is whether the action only runs after the job has finished.
+	Deferred bool `json:"deferred,omitempty"`
+	// Duration is how long the action ran, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Output is the output of the action, truncated to the first 64KiB.
+	Output string `json:"output,omitempty"`
+}
+
+// JobState is the state of an onboarding job.
+type JobState string
+
+const (
+	// JobStateRunning means that the job's actions are running.
+	JobStateRunning JobState = "running"
+	// JobStateSucceeded means that all of the job's actions succeeded.
+	JobStateSucceeded JobState = "succeeded"
+	// JobStateFailed means that an action failed or the job was cancelled.
+	JobStateFailed JobState = "failed"
+)
+
+// Job is the status of a single onboarding run.
+type Job struct {
+	ID       string     `json:"id"`
+	State    JobState   `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Action is the name of the action that failed, if any.
+	Action  string         `json:"action,omitempty"`
+	Actions []ActionStatus `json:"actions"`
+}
+
+// job tracks the progress of an onboarding run and notifies subscribers of every change.
+type job struct {
+	mu          sync.Mutex
+	status      Job
+	subscribers map[chan struct{}]struct{}
+}
+
+func newJob(id string, actions []Action) *job {
+	j := &job{
+		status: Job{
+			ID:      id,
+			State:   JobStateRunning,
+			Started: time.Now(),
+			Actions: make([]ActionStatus, len(actions)),
+		},
+		subscribers: make(map[chan struct{}]struct{}),
+	}
+	for i, a := range actions {
+		j.status.Actions[i] = ActionStatus{Name: a.Name, State: ActionStatePending, Deferred: a.Deferred}
+	}
+	return j
+}
+
+// snapshot returns a copy of the job's status.
+func (j *job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.status
+	s.Actions = make([]ActionStatus, len(j.status.Actions))
+	copy(s.Actions, j.status.Actions)
+	return s
+}
+
+// update applies the given function to the status and notifies subscribers.
+func (j *job) update(f func(*Job)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.status)
+	for ch := range j.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A notification is already pending, and subscribers
+			// always read the latest snapshot, so nothing is lost.
+		}
+	}
+}
+
+// subscribe returns a channel that is notified whenever the job changes.
+// The returned function must be called to unsubscribe.
+func (j *job) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.subscribers[ch] = struct{}{}
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		delete(j.subscribers, ch)
+	}
+}
+
+// run runs the actions that are not deferred in order, recording the status of each,
+// and then records the final state of the job.
+// Once an action fails or the context is cancelled, the remaining actions, including deferred ones, are skipped.
+func (j *job) run(ctx context.Context, actions []Action, values map[string]string) error {
+	err := j.runActions(ctx, actions, values, false, nil)
+	if err != nil {
+		// Deferred actions must not run if the job failed.
+		j.runActions(ctx, actions, values, true, err)
+	}
+	j.update(func(s *Job) {
+		now := time.Now()
+		s.Finished = &now
+		if err != nil {
+			s.State = JobStateFailed
+			s.Error = err.Error()
+			s.Action = failedAction(err)
+			return
+		}
+		s.State = JobStateSucceeded
+	})
+	return err
+}
+
+// runDeferred waits for the given delay, so that clients receive the final status of the job
+// before they are disconnected, and then runs the deferred actions in order.
+// A failure of a deferred action marks the job as failed after the fact.
+func (j *job) runDeferred(ctx context.Context, actions []Action, values map[string]string, delay time.Duration) error {
+	var deferred bool
+	for _, a := range actions {
+		deferred = deferred || a.Deferred
+	}
+	if !deferred {
+		return nil
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+		err = fmt.Errorf("onboarding was cancelled: %w", ctx.Err())
+	case <-time.After(delay):
+	}
+	if err = j.runActions(ctx, actions, values, true, err); err != nil {
+		j.update(func(s *Job) {
+			s.State = JobStateFailed
+			s.Error = err.Error()
+			s.Action = failedAction(err)
+		})
+	}
+	return err
+}
+
+// runActions runs the actions that are either deferred or not, as given, in order.
+// If err is not nil, or once an action fails or the context is cancelled, the remaining actions are skipped.
+func (j *job) runActions(ctx context.Context, actions []Action, values map[string]string, deferred bool, err error) error {
+	for i, a := range actions {
+		if a.Deferred != deferred {
+			continue
+		}
+		if err == nil {
+			if err = ctx.Err(); err != nil {
+				err = fmt.Errorf("onboarding was cancelled: %w", err)
+			}
+		}
+		if err != nil {
+			j.update(func(s *Job) { s.Actions[i].State = ActionStateSkipped })
+			continue
+		}
+		j.update(func(s *Job) { s.Actions[i].State = ActionStateRunning })
+		start := time.Now()
+		aerr := a.Run(ctx, values, &actionOutput{j: j, i: i})
+		j.update(func(s *Job) {
+			s.Actions[i].Duration = time.Since(start).Seconds()
+			if aerr != nil {
+				s.Actions[i].State = ActionStateFailed
+				s.Actions[i].Error = aerr.Error()
+				return
+			}
+			s.Actions[i].State = ActionStateSucceeded
+		})
+		if aerr != nil {
+			err = &actionError{name: a.Name, err: aerr}
+		}
+	}
+	return err
+}
+
+// actionError is an error returned by an action.
+type actionError struct {
+	name string
+	err  error
+}
+
+func (e *actionError) Error() string {
+	return fmt.Sprintf("action %q failed: %v", e.name, e.err)
+}
+
+func (e *actionError) Unwrap() error {
+	return e.err
+}
+
+// failedAction returns the name of the action that caused the error, if any.
+func failedAction(err error) string {
+	var ae *actionError
+	if errors.As(err, &ae) {
+		return ae.name
+	}
+	return ""
+}
+
+// actionOutput captures the output of an action in the job's status.
+type actionOutput struct {
+	j *job
+	i int
+}
+
+func (o *actionOutput) Write(p []byte) (int, error) {
+	o.j.update(func(s *Job) {
+		a := &s.Actions[o.i]
+		if n := maxActionOutput - len(a.Output); n > 0 {
+			if n > len(p) {
+				n = len(p)
+			}
+			a.Output += string(p[:n])
+		}
+	})
+	// Output beyond the limit is discarded rather than failing the action.
+	return len(p), nil
+}
+
+func writeJob(l log.Logger, w http.ResponseWriter, j Job) {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		msg := "failed to marshal job"
+		level.Error(l).Log("msg", msg, "error", err.Error())
+		httpError(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
+// newJobsHandler serves the status of a job at /api/v1/jobs/{id}
+// and a stream of its status at /api/v1/jobs/{id}/events, which ends once the job has finished,
+// i.e. before any deferred actions run.
+func newJobsHandler(l log.Logger, o *Onboarding) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/"), "/")
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "events") {
+			writeError(w, jsonError{Error: "not found", Code: ErrorCodeNotFound}, http.StatusNotFound)
+			return
+		}
+		j := o.job(parts[0])
+		if j == nil {
+			writeError(w, jsonError{Error: "job not found", Code: ErrorCodeNotFound, Job: parts[0]}, http.StatusNotFound)
+			return
+		}
+		if len(parts) == 1 {
+			writeJob(l, w, j.snapshot())
+			return
+		}
+		sseMiddleware(func(rw http.ResponseWriter, r *http.Request) {
+			sw := &sseWriter{rw.(http.Flusher), rw}
+			notify, unsubscribe := j.subscribe()
+			defer unsubscribe()
+			for {
+				s := j.snapshot()
+				buf, err := json.Marshal(s)
+				if err != nil {
+					level.Error(l).Log("msg", "failed to marshal job", "error", err.Error())
+					return
+				}
+				if _, err := sw.Write(buf); err != nil || s.State != JobStateRunning {
+					return
+				}
+				select {
+				case <-r.Context().Done():
+					return
+				case <-notify:
+				}
+			}
+		})(w, r)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// networkdLeaseDir is the directory in which systemd-networkd stores DHCP leases.
+const networkdLeaseDir = "/run/systemd/netif/leases"
+
+type leaseResponse struct {
+	Address string   `json:"address"`
+	Netmask string   `json:"netmask"`
+	Router  string   `json:"router,omitempty"`
+	Server  string   `json:"server,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	Domain  string   `json:"domain,omitempty"`
+	// Lifetime is the lifetime of the lease in seconds.
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// dhcpLease reads the DHCP lease that systemd-networkd acquired for the given interface.
+// If there is no lease for the interface, then nil is returned.
+func dhcpLease(ifindex int) (*leaseResponse, error) {
+	f, err := os.Open(filepath.Join(networkdLeaseDir, strconv.Itoa(ifindex)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open lease: %w", err)
+	}
+	defer f.Close()
+
+	var lr leaseResponse
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "ADDRESS":
+			lr.Address = parts[1]
+		case "NETMASK":
+			lr.Netmask = parts[1]
+		case "ROUTER":
+			lr.Router = parts[1]
+		case "SERVER_ADDRESS":
+			lr.Server = parts[1]
+		case "DNS":
+			lr.DNS = strings.Fields(parts[1])
+		case "DOMAINNAME":
+			lr.Domain = parts[1]
+		case "LIFETIME":
+			lr.Lifetime, _ = strconv.Atoi(parts[1])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read lease: %w", err)
+	}
+	return &lr, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/vishvananda/netlink"
+)
+
+type linkEventType string
+
+const (
+	linkLinkEventType    linkEventType = "link"
+	addressLinkEventType linkEventType = "address"
+	routeLinkEventType   linkEventType = "route"
+)
+
+type linkEvent struct {
+	Type      linkEventType `json:"type"`
+	Interface string        `json:"interface"`
+	// State is the operational state of the interface.
+	// It is only set for link events.
+	State string `json:"state,omitempty"`
+	// Address is the address that was added or removed.
+	// It is only set for address events.
+	Address string `json:"address,omitempty"`
+	// Gateway is the gateway of the default route that was added or removed.
+	// It is only set for route events.
+	Gateway string `json:"gateway,omitempty"`
+	// Deleted is true if the address or route was removed.
+	Deleted bool `json:"deleted"`
+}
+
+// watchLinks subscribes to netlink updates and writes an event to the
+// given writer for every change to the operational state, addresses,
+// or default route of the given interfaces.
+// The current state is written before any changes.
+// watchLinks blocks until the context is cancelled or a subscription fails.
+func watchLinks(ctx context.Context, l log.Logger, w io.Writer, ifaces ...string) error {
+	names := make(map[int]string)
+	managed := make(map[string]struct{}, len(ifaces))
+	for _, iface := range ifaces {
+		managed[iface] = struct{}{}
+		// The interface may not exist yet, in which case
+		// its index is learned from link updates.
+		if li, err := netlink.LinkByName(iface); err == nil {
+			names[li.Attrs().Index] = iface
+		}
+	}
+
+	done := make(chan struct{})
+	lc := make(chan netlink.LinkUpdate)
+	ac := make(chan netlink.AddrUpdate)
+	rc := make(chan netlink.RouteUpdate)
+	defer func(lc chan netlink.LinkUpdate, ac chan netlink.AddrUpdate, rc chan netlink.RouteUpdate) {
+		close(done)
+		// Drain the channels so that the subscription goroutines are not blocked on a send and can exit.
+		// They are blocked receiving from netlink sockets without a timeout and only notice
+		// that done is closed once another update arrives, so the drain must not block the return.
+		go func() {
+			for range lc {
+			}
+		}()
+		go func() {
+			for range ac {
+			}
+		}()
+		go func() {
+			for range rc {
+			}
+		}()
+	}(lc, ac, rc)
+	cberr := func(err error) {
+		level.Warn(l).Log("msg", "netlink subscription failed", "error", err.Error())
+	}
+	if err := netlink.LinkSubscribeWithOptions(lc, done, netlink.LinkSubscribeOptions{ErrorCallback: cberr, ListExisting: true}); err != nil {
+		close(lc)
+		close(ac)
+		close(rc)
+		return err
+	}
+	if err := netlink.AddrSubscribeWithOptions(ac, done, netlink.AddrSubscribeOptions{ErrorCallback: cberr, ListExisting: true}); err != nil {
+		close(ac)
+		close(rc)
+		return err
+	}
+	if err := netlink.RouteSubscribeWithOptions(rc, done, netlink.RouteSubscribeOptions{ErrorCallback: cberr, ListExisting: true}); err != nil {
+		close(rc)
+		return err
+	}
+
+	write := func(e *linkEvent) error {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	}
+	for {
+		var e *linkEvent
+		select {
+		case <-ctx.Done():
+			return nil
+		case u, ok := <-lc:
+			if !ok {
+				lc = nil
+				return errors.New("link subscription closed")
+			}
+			if _, ok := managed[u.Attrs().Name]; !ok {
+				continue
+			}
+			names[u.Attrs().Index] = u.Attrs().Name
+			e = &linkEvent{
+				Type:      linkLinkEventType,
+				Interface: u.Attrs().Name,
+				State:     u.Attrs().OperState.String(),
+				Deleted:   u.Header.Type == syscall.RTM_DELLINK,
+			}
+		case u, ok := <-ac:
+			if !ok {
+				ac = nil
+				return errors.New("address subscription closed")
+			}
+			name, ok := names[u.LinkIndex]
+			if !ok {
+				continue
+			}
+			e = &linkEvent{
+				Type:      addressLinkEventType,
+				Interface: name,
+				Address:   u.LinkAddress.String(),
+				Deleted:   !u.NewAddr,
+			}
+		case u, ok := <-rc:
+			if !ok {
+				rc = nil
+				return errors.New("route subscription closed")
+			}
+			// Only default routes are interesting.
+			if u.Dst != nil {
+				continue
+			}
+			name, ok := names[u.LinkIndex]
+			if !ok {
+				continue
+			}
+			e = &linkEvent{
+				Type:      routeLinkEventType,
+				Interface: name,
+				Deleted:   u.Type == syscall.RTM_DELROUTE,
+			}
+			if u.Gw != nil {
+				e.Gateway = u.Gw.String()
+			}
+		}
+		if err := write(e); err != nil {
+			return err
+		}
+	}
+}
+
+func newLinkEventsHandler(l log.Logger, ifaces ...string) func(http.ResponseWriter, *http.Request) {
+	return sseMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if err := watchLinks(r.Context(), l, &sseWriter{w.(http.Flusher), w}, ifaces...); err != nil {
+			msg := "failed to watch links"
+			http.Error(w, msg, http.StatusInternalServerError)
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			return
+		}
+	})
+}
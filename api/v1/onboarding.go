@@ -0,0 +1,561 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// OnboardingState is the state of the device's onboarding.
+type OnboardingState string
+
+const (
+	// OnboardingStateUnonboarded means that the device has never been onboarded.
+	OnboardingStateUnonboarded OnboardingState = "unonboarded"
+	// OnboardingStateInProgress means that the actions are running.
+	OnboardingStateInProgress OnboardingState = "in-progress"
+	// OnboardingStateOnboarded means that all actions succeeded.
+	OnboardingStateOnboarded OnboardingState = "onboarded"
+	// OnboardingStateFailed means that an action failed or was interrupted.
+	OnboardingStateFailed OnboardingState = "failed"
+)
+
+// OnboardingStatus is the persisted status of the device's onboarding.
+type OnboardingStatus struct {
+	State   OnboardingState `json:"state"`
+	Updated time.Time       `json:"updated"`
+	// Error is the error that caused onboarding to fail, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// OnboardingOptions configures onboarding.
+type OnboardingOptions struct {
+	// Actions are run in order with the submitted values.
+	Actions []Action
+	// Complete, if set, adds default and computed values to the submitted values before they are validated.
+	// Errors caused by specific values should be ValueError or ValueErrors.
+	Complete func(values map[string]string) error
+	// CurrentValues, if set, reads the current values from the system, so that clients can prefill inputs.
+	// Errors caused by specific values should be ValueErrors; the values that were read are served nonetheless.
+	CurrentValues func(ctx context.Context) (map[string]string, error)
+	// ListOptions, if set, lists the options of the select with the given name, so that clients can offer them.
+	// If the value does not have options that can be listed, the error should be a ValueError.
+	ListOptions func(ctx context.Context, name string) ([]string, error)
+	// Validate, if set, validates the submitted values before any action runs.
+	// Errors caused by specific values should be ValueError or ValueErrors; any other error is an internal error.
+	Validate func(values map[string]string) error
+	// Secrets are the names of the values that clients must encrypt with the public part of Key.
+	Secrets []string
+	Key     *rsa.PrivateKey
+	// Files constrain the values that clients may upload as files in multipart requests, by name.
+	Files map[string]File
+	// Registrar, if set, registers the device once it has been onboarded.
+	Registrar Registrar
+	// Pairing, if set, allows paired clients to re-onboard the device.
+	Pairing *Pairing
+	// StatePath is the file in which the status is persisted.
+	StatePath string
+	// InitialState is the state of the device if no status has been persisted yet,
+	// e.g. because the device was onboarded by an older version of Onboard.
+	InitialState OnboardingState
+	// DeferredDelay is how long to wait after a job has finished before running its deferred actions.
+	DeferredDelay time.Duration
+	// ReonboardFile is a file whose existence allows the device to be re-onboarded once,
+	// e.g. created by a physical button. It is removed when re-onboarding starts.
+	ReonboardFile string
+}
+
+// Onboarding runs the actions with submitted values in the background and tracks the state of the device.
+// Every run is a job whose progress can be followed by clients.
+// Only one job may be in flight at a time; concurrent submissions are rejected.
+// Once the device is onboarded, it refuses to be onboarded again unless re-onboarding is enabled
+// by the re-onboard file, by a request from the device itself, or by a paired client.
+type Onboarding struct {
+	l    log.Logger
+	opts OnboardingOptions
+	// ctx is cancelled when Onboarding is stopped, which cancels any job in flight.
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu     sync.Mutex
+	status OnboardingStatus
+	// current is the ID of the job that is in flight, if any.
+	current string
+	// jobs are the recent jobs by ID; order lists their IDs from oldest to newest.
+	jobs  map[string]*job
+	order []string
+}
+
+// NewOnboarding creates a new Onboarding, loading any persisted status.
+// A status that was persisted while onboarding was in progress is treated as failed.
+func NewOnboarding(l log.Logger, opts OnboardingOptions) (*Onboarding, error) {
+	o := &Onboarding{
+		l:      l,
+		opts:   opts,
+		status: OnboardingStatus{State: opts.InitialState, Updated: time.Now()},
+		jobs:   make(map[string]*job),
+	}
+	o.ctx, o.stop = context.WithCancel(context.Background())
+	data, err := ioutil.ReadFile(opts.StatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read onboarding state: %w", err)
+		}
+		return o, nil
+	}
+	if err := json.Unmarshal(data, &o.status); err != nil {
+		return nil, fmt.Errorf("failed to parse onboarding state: %w", err)
+	}
+	if o.status.State == OnboardingStateInProgress {
+		o.setStatus(OnboardingStateFailed, errors.New("onboarding was interrupted"))
+	}
+	return o, nil
+}
+
+// Run blocks until the given context is cancelled.
+// It then cancels the job in flight, if any, and waits for it to stop,
+// so that no action is interrupted by the process exiting.
+func (o *Onboarding) Run(ctx context.Context) error {
+	<-ctx.Done()
+	o.stop()
+	o.wg.Wait()
+	return nil
+}
+
+// State returns the current onboarding state.
+func (o *Onboarding) State() OnboardingState {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status.State
+}
+
+// setStatus updates and persists the status. It must be called with the lock held.
+func (o *Onboarding) setStatus(state OnboardingState, err error) {
+	o.status = OnboardingStatus{State: state, Updated: time.Now()}
+	if err != nil {
+		o.status.Error = err.Error()
+	}
+	buf, err := json.Marshal(o.status)
+	if err != nil {
+		level.Error(o.l).Log("msg", "failed to marshal onboarding state", "error", err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(o.opts.StatePath), 0755); err != nil {
+		level.Error(o.l).Log("msg", "failed to create directory for onboarding state", "error", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(o.opts.StatePath, buf, 0644); err != nil {
+		level.Error(o.l).Log("msg", "failed to write onboarding state", "error", err.Error())
+	}
+}
+
+// reonboardAllowed returns whether the request may onboard a device that is already onboarded,
+// and whether that permission comes from the re-onboard file.
+func (o *Onboarding) reonboardAllowed(r *http.Request) (bool, bool) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return true, false
+		}
+	}
+	if o.opts.Pairing != nil && o.opts.Pairing.Authorized(r) {
+		return true, false
+	}
+	if o.opts.ReonboardFile != "" {
+		if _, err := os.Stat(o.opts.ReonboardFile); err == nil {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// errOnboardingInProgress is returned by begin if another job is already in flight.
+var errOnboardingInProgress = errors.New("onboarding is already in progress")
+
+// begin reserves the single onboarding slot for a new job and returns it.
+// If another job is in flight, then its ID is returned along with errOnboardingInProgress.
+func (o *Onboarding) begin() (*job, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current != "" {
+		return nil, o.current, errOnboardingInProgress
+	}
+	if err := o.ctx.Err(); err != nil {
+		return nil, "", fmt.Errorf("onboarding is stopping: %w", err)
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", fmt.Errorf("failed to generate job ID: %w", err)
+	}
+	j := newJob(hex.EncodeToString(buf), o.opts.Actions)
+	o.current = j.status.ID
+	o.jobs[o.current] = j
+	o.order = append(o.order, o.current)
+	if len(o.order) > jobsHistory {
+		delete(o.jobs, o.order[0])
+		o.order = o.order[1:]
+	}
+	o.setStatus(OnboardingStateInProgress, nil)
+	o.wg.Add(1)
+	return j, o.current, nil
+}
+
+// job returns the job with the given ID, or nil if there is none.
+func (o *Onboarding) job(id string) *job {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.jobs[id]
+}
+
+// run runs the job with the given values, records the resulting state,
+// and releases the onboarding slot reserved by begin once any deferred actions have run.
+func (o *Onboarding) run(j *job, values map[string]string) {
+	defer o.wg.Done()
+	defer func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.current = ""
+	}()
+	fail := func(err error) {
+		o.mu.Lock()
+		o.setStatus(OnboardingStateFailed, err)
+		o.mu.Unlock()
+		level.Error(o.l).Log("msg", "onboarding failed", "job", j.status.ID, "error", err.Error())
+	}
+	if err := j.run(o.ctx, o.opts.Actions, values); err != nil {
+		fail(err)
+		return
+	}
+	o.mu.Lock()
+	o.setStatus(OnboardingStateOnboarded, nil)
+	o.mu.Unlock()
+	level.Info(o.l).Log("msg", "onboarding succeeded", "job", j.status.ID)
+	if o.opts.Registrar != nil {
+		o.opts.Registrar.Register(values)
+	}
+	if err := j.runDeferred(o.ctx, o.opts.Actions, values, o.opts.DeferredDelay); err != nil {
+		fail(err)
+	}
+}
+
+type jobResponse struct {
+	// Job is the ID of the onboarding run.
+	Job string `json:"job"`
+}
+
+type stateResponse struct {
+	OnboardingStatus
+	// Reonboard is whether the requesting client may onboard the device even if it is already onboarded.
+	Reonboard bool `json:"reonboard"`
+}
+
+func newStateHandler(l log.Logger, o *Onboarding) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		res := stateResponse{OnboardingStatus: o.status}
+		o.mu.Unlock()
+		res.Reonboard, _ = o.reonboardAllowed(r)
+		buf, err := json.Marshal(res)
+		if err != nil {
+			msg := "failed to marshal onboarding state"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
+
+const (
+	// maxValueSize is the maximum size in bytes of a submitted value that is not a file.
+	maxValueSize = 1 << 20
+	// maxRequestSize is the maximum size in bytes of an onboarding request,
+	// to which the maximum sizes of all files are added.
+	maxRequestSize = 8 << 20
+)
+
+// File constrains a value that is uploaded as a file.
+type File struct {
+	// MaxSize is the maximum size of the file in bytes.
+	// Zero means that the file is only limited by the maximum size of the request.
+	MaxSize int64
+	// ContentTypes are the allowed media types of the file, e.g. text/plain or image/*.
+	// If empty, any type is allowed.
+	ContentTypes []string
+}
+
+// allows returns whether the given media type is allowed.
+func (f File) allows(contentType string) bool {
+	if len(f.ContentTypes) == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range f.ContentTypes {
+		if ct == mt || ct == "*/*" || (strings.HasSuffix(ct, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(ct, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestLimit returns the maximum size in bytes of an onboarding request with the given files.
+func requestLimit(files map[string]File) int64 {
+	limit := int64(maxRequestSize)
+	for _, f := range files {
+		limit += f.MaxSize
+	}
+	return limit
+}
+
+// maxSize returns the maximum size in bytes of the value with the given name.
+// Zero means that the value is only limited by the maximum size of the request.
+func maxSize(name string, files map[string]File) int64 {
+	if f, ok := files[name]; ok {
+		return f.MaxSize
+	}
+	return maxValueSize
+}
+
+// parseOnboardRequest parses a JSON object of values.
+// Booleans and numbers are accepted and converted to their string representation.
+// Values that are files must not exceed their maximum size,
+// but their media types cannot be checked, since JSON strings do not have one.
+func parseOnboardRequest(body []byte, files map[string]File) (map[string]string, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("request must be a JSON object of values: %w", err)
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		var x interface{}
+		if err := d.Decode(&x); err != nil {
+			return nil, &ValueError{Name: k, Err: err}
+		}
+		switch x := x.(type) {
+		case string:
+			values[k] = x
+		case bool:
+			values[k] = strconv.FormatBool(x)
+		case json.Number:
+			values[k] = x.String()
+		default:
+			return nil, &ValueError{Name: k, Err: errors.New("must be a string, boolean, or number")}
+		}
+		if max := maxSize(k, files); max > 0 && int64(len(values[k])) > max {
+			return nil, &ValueError{Name: k, Err: fmt.Errorf("must be at most %d bytes", max)}
+		}
+	}
+	return values, nil
+}
+
+// parseMultipartOnboardRequest parses a multipart form of values.
+// Values that are files must be uploaded as files and satisfy the given constraints,
+// unless they are left empty.
+func parseMultipartOnboardRequest(mr *multipart.Reader, files map[string]File) (map[string]string, error) {
+	values := make(map[string]string)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart request: %w", err)
+		}
+		name := p.FormName()
+		if name == "" {
+			return nil, errors.New("every part of the request must be a form field")
+		}
+		if _, ok := values[name]; ok {
+			return nil, &ValueError{Name: name, Err: errors.New("was submitted more than once")}
+		}
+		f, isFile := files[name]
+		if p.FileName() != "" {
+			if !isFile {
+				return nil, &ValueError{Name: name, Err: errors.New("cannot be uploaded as a file")}
+			}
+			// Parts without a content type are binary data.
+			ct := p.Header.Get("Content-Type")
+			if ct == "" {
+				ct = "application/octet-stream"
+			}
+			if !f.allows(ct) {
+				return nil, &ValueError{Name: name, Err: fmt.Errorf("must be a file of type %s", strings.Join(f.ContentTypes, ", "))}
+			}
+		}
+		// Reading one byte more than allowed detects values that are too large without reading all of them.
+		var r io.Reader = p
+		max := maxSize(name, files)
+		if max > 0 {
+			r = io.LimitReader(p, max+1)
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value %q: %w", name, err)
+		}
+		if max > 0 && int64(len(buf)) > max {
+			return nil, &ValueError{Name: name, Err: fmt.Errorf("must be at most %d bytes", max)}
+		}
+		// Empty fields are how clients leave out optional files.
+		if isFile && p.FileName() == "" && len(buf) > 0 {
+			return nil, &ValueError{Name: name, Err: errors.New("must be uploaded as a file")}
+		}
+		values[name] = string(buf)
+	}
+}
+
+func newOnboardHandler(l log.Logger, o *Onboarding) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, jsonError{Error: "method not allowed", Code: ErrorCodeInvalidRequest}, http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, requestLimit(o.opts.Files))
+
+		// Clients that upload files submit a multipart form; all others submit a JSON object.
+		var onboardRequest map[string]string
+		var err error
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+			var mr *multipart.Reader
+			if mr, err = r.MultipartReader(); err != nil {
+				writeError(w, jsonError{Error: fmt.Sprintf("failed to read multipart request: %v", err), Code: ErrorCodeInvalidRequest}, http.StatusBadRequest)
+				return
+			}
+			onboardRequest, err = parseMultipartOnboardRequest(mr, o.opts.Files)
+		} else {
+			var body []byte
+			if body, err = ioutil.ReadAll(r.Body); err != nil {
+				level.Debug(l).Log("msg", "failed to read request", "error", err.Error())
+				writeError(w, jsonError{Error: fmt.Sprintf("failed to read request: %v", err), Code: ErrorCodeInvalidRequest}, http.StatusBadRequest)
+				return
+			}
+			onboardRequest, err = parseOnboardRequest(body, o.opts.Files)
+		}
+		if err != nil {
+			e := jsonError{Error: err.Error(), Code: ErrorCodeInvalidRequest}
+			var ve *ValueError
+			if errors.As(err, &ve) {
+				e = valueErrorResponse(err)
+			}
+			level.Debug(l).Log("msg", "rejecting invalid onboarding request", "error", err.Error())
+			writeError(w, e, http.StatusBadRequest)
+			return
+		}
+
+		if err := decryptSecrets(o.opts.Key, o.opts.Secrets, onboardRequest); err != nil {
+			level.Debug(l).Log("msg", "failed to decrypt secret values", "error", err.Error())
+			writeError(w, valueErrorResponse(err), http.StatusBadRequest)
+			return
+		}
+
+		if o.opts.Complete != nil {
+			if err := o.opts.Complete(onboardRequest); err != nil {
+				level.Debug(l).Log("msg", "failed to complete values", "error", err.Error())
+				writeError(w, valueErrorResponse(err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Values are validated once they are decrypted and completed and before any action runs.
+		if o.opts.Validate != nil {
+			if err := o.opts.Validate(onboardRequest); err != nil {
+				var ves ValueErrors
+				var ve *ValueError
+				if !errors.As(err, &ves) && !errors.As(err, &ve) {
+					msg := "failed to validate values"
+					level.Error(l).Log("msg", msg, "error", err.Error())
+					writeError(w, jsonError{Error: msg, Code: ErrorCodeInternal}, http.StatusInternalServerError)
+					return
+				}
+				level.Debug(l).Log("msg", "rejecting invalid values", "error", err.Error())
+				writeError(w, valueErrorResponse(err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The re-onboard file must only be consumed by a submission that actually starts a run.
+		reonboardFile := false
+		if o.State() == OnboardingStateOnboarded {
+			allowed, viaFile := o.reonboardAllowed(r)
+			if !allowed {
+				writeError(w, jsonError{Error: "device is already onboarded and re-onboarding is not enabled", Code: ErrorCodeAlreadyOnboarded}, http.StatusForbidden)
+				return
+			}
+			reonboardFile = viaFile
+		}
+
+		j, id, err := o.begin()
+		if err == errOnboardingInProgress {
+			writeError(w, jsonError{Error: err.Error(), Code: ErrorCodeInProgress, Job: id}, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			msg := "failed to start onboarding"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			writeError(w, jsonError{Error: msg, Code: ErrorCodeInternal}, http.StatusInternalServerError)
+			return
+		}
+		if reonboardFile {
+			if err := os.Remove(o.opts.ReonboardFile); err != nil {
+				level.Warn(l).Log("msg", "failed to remove re-onboard file", "error", err.Error())
+			}
+		}
+		level.Info(l).Log("msg", "starting onboarding", "job", id)
+
+		// The job runs in the background, so that it is not interrupted
+		// if the client loses its connection, e.g. because the actions change the network.
+		go o.run(j, onboardRequest)
+
+		buf, err := json.Marshal(jobResponse{Job: id})
+		if err != nil {
+			msg := "failed to marshal job"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			writeError(w, jsonError{Error: msg, Code: ErrorCodeInternal, Job: id}, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Location", "/api/v1/jobs/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(buf)
+	}
+}
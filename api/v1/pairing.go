@@ -0,0 +1,225 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// pairingMaxFailures is the number of consecutive failed pairing attempts
+	// after which pairing is locked.
+	pairingMaxFailures = 5
+	// pairingLockout is how long pairing is locked after too many failed attempts.
+	// It doubles with every further failed attempt up to pairingMaxLockout.
+	pairingLockout    = time.Minute
+	pairingMaxLockout = time.Hour
+	// sessionCookie is the name of the cookie in which the session token is stored for browsers.
+	sessionCookie = "onboard_session"
+)
+
+// protectedPrefixes are the paths of read-only endpoints that nevertheless require a session,
+// since they expose logs, the output of actions, or the current configuration of the device.
+var protectedPrefixes = []string{"/api/v1/log/", "/api/v1/events/wifi", "/api/v1/jobs/", "/api/v1/values/current"}
+
+// Pairing requires clients to pair with a PIN before they can use mutating and log endpoints.
+// Pairing yields a session token that must be sent either as a bearer token or in a cookie.
+// Consecutive failed attempts lock pairing for an increasing amount of time
+// to prevent the PIN from being brute-forced.
+type Pairing struct {
+	l   log.Logger
+	pin string
+	ttl time.Duration
+
+	mu          sync.Mutex
+	sessions    map[string]time.Time
+	failures    int
+	lockedUntil time.Time
+
+	attempts *prometheus.CounterVec
+}
+
+// NewPairing creates a new Pairing that accepts the given PIN
+// and issues sessions that are valid for the given duration.
+func NewPairing(r prometheus.Registerer, l log.Logger, pin string, ttl time.Duration) *Pairing {
+	p := &Pairing{
+		l:        l,
+		pin:      pin,
+		ttl:      ttl,
+		sessions: make(map[string]time.Time),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "onboard_pairing_attempts_total",
+			Help: "Number of attempts to pair with the device.",
+		}, []string{"result"}),
+	}
+	if r != nil {
+		r.MustRegister(p.attempts)
+	}
+	return p
+}
+
+// Protect wraps the given API handler so that it serves the pairing endpoint
+// and requires a session for mutating and log endpoints.
+func (p *Pairing) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/pair" {
+			p.pair(w, r)
+			return
+		}
+		if protected(r) && !p.Authorized(r) {
+			httpError(w, "pairing is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func protected(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return true
+	}
+	for _, prefix := range protectedPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorized returns whether the request carries a valid session token.
+func (p *Pairing) Authorized(r *http.Request) bool {
+	var token string
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	} else if c, err := r.Cookie(sessionCookie); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for t, expires := range p.sessions {
+		if now.After(expires) {
+			delete(p.sessions, t)
+		}
+	}
+	_, ok := p.sessions[token]
+	return ok
+}
+
+type pairRequest struct {
+	PIN string `json:"pin"`
+}
+
+type pairResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (p *Pairing) pair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		msg := "failed to read request"
+		level.Error(p.l).Log("msg", msg, "error", err.Error())
+		httpError(w, msg, http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	var pr pairRequest
+	if err := json.Unmarshal(body, &pr); err != nil {
+		httpError(w, "failed to unmarshal request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if now.Before(p.lockedUntil) {
+		retry := p.lockedUntil.Sub(now)
+		p.mu.Unlock()
+		p.attempts.WithLabelValues("locked").Inc()
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retry.Seconds()))))
+		httpError(w, "too many failed attempts; try again later", http.StatusTooManyRequests)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(pr.PIN), []byte(p.pin)) != 1 {
+		p.failures++
+		if p.failures >= pairingMaxFailures {
+			lockout := pairingLockout << uint(p.failures-pairingMaxFailures)
+			if lockout > pairingMaxLockout || lockout <= 0 {
+				lockout = pairingMaxLockout
+			}
+			p.lockedUntil = now.Add(lockout)
+			level.Warn(p.l).Log("msg", "locking pairing after too many failed attempts", "failures", p.failures, "duration", lockout)
+		}
+		p.mu.Unlock()
+		p.attempts.WithLabelValues("failure").Inc()
+		httpError(w, "incorrect PIN", http.StatusForbidden)
+		return
+	}
+	p.failures = 0
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		p.mu.Unlock()
+		msg := "failed to generate session token"
+		level.Error(p.l).Log("msg", msg, "error", err.Error())
+		httpError(w, msg, http.StatusInternalServerError)
+		return
+	}
+	res := pairResponse{Token: hex.EncodeToString(buf), Expires: now.Add(p.ttl)}
+	p.sessions[res.Token] = res.Expires
+	p.mu.Unlock()
+	p.attempts.WithLabelValues("success").Inc()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    res.Token,
+		Path:     "/api/",
+		Expires:  res.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	out, err := json.Marshal(res)
+	if err != nil {
+		msg := "failed to marshal session"
+		level.Error(p.l).Log("msg", msg, "error", err.Error())
+		httpError(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(out)
+}
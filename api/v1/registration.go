@@ -0,0 +1,77 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// RegistrationState is the state of the device's registration with a fleet backend.
+type RegistrationState string
+
+const (
+	// RegistrationStateDisabled means that no registration endpoint is configured.
+	RegistrationStateDisabled RegistrationState = "disabled"
+	// RegistrationStatePending means that the device has not yet been onboarded
+	// or that the checks have not yet passed.
+	RegistrationStatePending RegistrationState = "pending"
+	// RegistrationStateRegistering means that the device is trying to register.
+	RegistrationStateRegistering RegistrationState = "registering"
+	// RegistrationStateRegistered means that the backend accepted the registration.
+	RegistrationStateRegistered RegistrationState = "registered"
+)
+
+// RegistrationStatus describes the progress of the device's registration.
+type RegistrationStatus struct {
+	State RegistrationState `json:"state"`
+	// Attempts is the number of times registration has been attempted.
+	Attempts int `json:"attempts"`
+	// Error is the error from the most recent attempt, if any.
+	Error        string     `json:"error,omitempty"`
+	LastAttempt  *time.Time `json:"lastAttempt,omitempty"`
+	RegisteredAt *time.Time `json:"registeredAt,omitempty"`
+}
+
+// Registrar registers the device with a fleet backend once it has been onboarded.
+type Registrar interface {
+	// Register starts registering the device using the values with which it was onboarded.
+	// It must not block.
+	Register(values map[string]string)
+	// Status returns the current status of the registration.
+	Status() RegistrationStatus
+}
+
+func newRegistrationHandler(l log.Logger, registrar Registrar) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := RegistrationStatus{State: RegistrationStateDisabled}
+		if registrar != nil {
+			status = registrar.Status()
+		}
+		buf, err := json.Marshal(status)
+		if err != nil {
+			msg := "failed to marshal registration status"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
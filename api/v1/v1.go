@@ -15,11 +15,13 @@
 package v1
 
 import (
+	"crypto"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -29,53 +31,46 @@ import (
 )
 
 // New instantiates a API that conforms to the http.Handler interface.
-func New(r prometheus.Registerer, l log.Logger, id, wlanInterface string, actions []func(map[string]string) error) http.Handler {
+// The given configuration is the JSON-encoded configuration that is served to clients.
+func New(r prometheus.Registerer, l log.Logger, wlanInterface string, configuration []byte, onboarding *Onboarding, wifiEvents *WiFiEvents, identity crypto.PublicKey) http.Handler {
 	hi := signalhttp.NewHandlerInstrumenter(r, []string{"handler"})
 	m := http.NewServeMux()
 
 	m.HandleFunc("/api/v1/log/systemd-networkd", hi.NewHandler(prometheus.Labels{"handler": "log-systemd-networkd"}, http.HandlerFunc(newLogHandler(l, logReaderForMatcher("SYSLOG_IDENTIFIER=systemd-networkd", fmt.Sprintf("INTERFACE=%s", wlanInterface))))))
 	m.HandleFunc("/api/v1/log/wpa_supplicant", hi.NewHandler(prometheus.Labels{"handler": "log-systemd-networkd"}, http.HandlerFunc(newLogHandler(l, logReaderForMatcher(fmt.Sprintf("SYSLOG_IDENTIFIER=wpa_supplicant@%s", wlanInterface))))))
+	m.HandleFunc("/api/v1/events/wifi", hi.NewHandler(prometheus.Labels{"handler": "events-wifi"}, http.HandlerFunc(newWiFiEventsHandler(l, wifiEvents))))
+	m.HandleFunc("/api/v1/events/link", hi.NewHandler(prometheus.Labels{"handler": "events-link"}, http.HandlerFunc(newLinkEventsHandler(l, wlanInterface))))
 	m.HandleFunc("/api/v1/status/link", hi.NewHandler(prometheus.Labels{"handler": "status-link"}, http.HandlerFunc(newLinkHandler(l, wlanInterface))))
 	m.HandleFunc("/api/v1/status/dns", hi.NewHandler(prometheus.Labels{"handler": "status-dns"}, http.HandlerFunc(newDNSHandler(l))))
+	m.HandleFunc("/api/v1/status/registration", hi.NewHandler(prometheus.Labels{"handler": "status-registration"}, http.HandlerFunc(newRegistrationHandler(l, onboarding.opts.Registrar))))
 	m.HandleFunc("/api/v1/status/systemd", hi.NewHandler(prometheus.Labels{"handler": "status-systemd"}, http.HandlerFunc(newSystemctlShowHandler(l))))
-	m.HandleFunc("/api/v1/onboard", hi.NewHandler(prometheus.Labels{"handler": "onboard"}, http.HandlerFunc(newOnboardHandler(l, id, actions))))
+	m.HandleFunc("/api/v1/diagnose/network", hi.NewHandler(prometheus.Labels{"handler": "diagnose-network"}, http.HandlerFunc(newDiagnoseHandler(l, wlanInterface))))
+	m.HandleFunc("/api/v1/identity", hi.NewHandler(prometheus.Labels{"handler": "identity"}, http.HandlerFunc(newIdentityHandler(l, identity))))
+	m.HandleFunc("/api/v1/config", hi.NewHandler(prometheus.Labels{"handler": "config"}, http.HandlerFunc(newConfigHandler(configuration))))
+	m.HandleFunc("/api/v1/state", hi.NewHandler(prometheus.Labels{"handler": "state"}, http.HandlerFunc(newStateHandler(l, onboarding))))
+	m.HandleFunc("/api/v1/onboard", hi.NewHandler(prometheus.Labels{"handler": "onboard"}, http.HandlerFunc(newOnboardHandler(l, onboarding))))
+	m.HandleFunc("/api/v1/jobs/", hi.NewHandler(prometheus.Labels{"handler": "jobs"}, http.HandlerFunc(newJobsHandler(l, onboarding))))
+	m.HandleFunc("/api/v1/values/options/", hi.NewHandler(prometheus.Labels{"handler": "values-options"}, http.HandlerFunc(newOptionsHandler(l, onboarding))))
+	m.HandleFunc("/api/v1/values/current", hi.NewHandler(prometheus.Labels{"handler": "values-current"}, http.HandlerFunc(newCurrentValuesHandler(l, onboarding))))
 
 	return m
 }
 
-func newOnboardHandler(l log.Logger, id string, actions []func(map[string]string) error) func(http.ResponseWriter, *http.Request) {
+func newConfigHandler(configuration []byte) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			msg := "failed to read request"
-			level.Error(l).Log("msg", msg, "error", err.Error())
-			httpError(w, msg, http.StatusInternalServerError)
-			return
-		}
-		defer r.Body.Close()
-
-		onboardRequest := make(map[string]string)
-		if err := json.Unmarshal(body, &onboardRequest); err != nil {
-			msg := "failed to unmarshal request"
-			level.Error(l).Log("msg", msg, "error", err.Error())
-			httpError(w, msg, http.StatusInternalServerError)
-			return
-		}
-
-		for _, a := range actions {
-			if err := a(onboardRequest); err != nil {
-				msg := "failed to execute action"
-				level.Error(l).Log("msg", msg, "error", err.Error())
-				httpError(w, msg, http.StatusInternalServerError)
-				return
-			}
-		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(configuration)
 	}
 }
 
 type linkResponse struct {
 	Addresses []string `json:"addresses"`
 	State     string   `json:"state"`
+	Gateway   string   `json:"gateway,omitempty"`
+	// Wireless is only set if the interface is associated with an access point.
+	Wireless *wirelessResponse `json:"wireless,omitempty"`
+	// Lease is only set if the interface acquired an address via DHCP.
+	Lease *leaseResponse `json:"lease,omitempty"`
 }
 
 func newLinkHandler(l log.Logger, iface string) func(http.ResponseWriter, *http.Request) {
@@ -98,10 +93,32 @@ func newLinkHandler(l log.Logger, iface string) func(http.ResponseWriter, *http.
 		for _, a := range addressList {
 			addresses = append(addresses, a.String())
 		}
-		buf, err := json.Marshal(linkResponse{
+		lr := linkResponse{
 			Addresses: addresses,
 			State:     li.Attrs().OperState.String(),
-		})
+		}
+		gw, err := defaultGateway(li)
+		if err != nil {
+			msg := "failed to list routes"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		if gw != nil {
+			lr.Gateway = gw.String()
+		}
+		// Not every interface is wireless, so failing to get the
+		// wireless status should not fail the entire request.
+		if lr.Wireless, err = wirelessStatus(li.Attrs().Index); err != nil && err != errNotAssociated {
+			level.Debug(l).Log("msg", "failed to get wireless status", "error", err.Error())
+		}
+		if lr.Lease, err = dhcpLease(li.Attrs().Index); err != nil {
+			msg := "failed to read DHCP lease"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		buf, err := json.Marshal(lr)
 		if err != nil {
 			msg := "failed to marshal response"
 			level.Error(l).Log("msg", msg, "error", err.Error())
@@ -122,7 +139,7 @@ func newDNSHandler(l log.Logger) func(http.ResponseWriter, *http.Request) {
 			httpError(w, msg, http.StatusBadRequest)
 			return
 		}
-		names, err := net.LookupHost(h)
+		names, err := net.DefaultResolver.LookupHost(r.Context(), h)
 		if err != nil {
 			msg := "failed to lookup hostname"
 			level.Error(l).Log("msg", msg, "error", err.Error())
@@ -138,12 +155,109 @@ func newDNSHandler(l log.Logger) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// defaultGateway returns the gateway of the default route for the given link.
+// If the link has no default route, then nil is returned.
+func defaultGateway(li netlink.Link) (net.IP, error) {
+	routes, err := netlink.RouteList(li, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route.Gw, nil
+		}
+	}
+	return nil, nil
+}
+
+// ErrorCode identifies the kind of an error, so that clients can react to it
+// without parsing the message.
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidRequest means that the request could not be parsed.
+	ErrorCodeInvalidRequest ErrorCode = "invalid-request"
+	// ErrorCodeInvalidValue means that a submitted value is invalid.
+	ErrorCodeInvalidValue ErrorCode = "invalid-value"
+	// ErrorCodeAlreadyOnboarded means that the device is onboarded and may not be onboarded again.
+	ErrorCodeAlreadyOnboarded ErrorCode = "already-onboarded"
+	// ErrorCodeInProgress means that another onboarding job is in flight.
+	ErrorCodeInProgress ErrorCode = "in-progress"
+	// ErrorCodeNotFound means that the requested resource does not exist.
+	ErrorCodeNotFound ErrorCode = "not-found"
+	// ErrorCodeInternal means that the device failed to handle a valid request.
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
 type jsonError struct {
-	Error string `json:"error"`
+	// Error is a human-friendly message.
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code,omitempty"`
+	// Value is the name of the submitted value that caused the error, if any.
+	Value string `json:"value,omitempty"`
+	// Fields maps the names of all of the submitted values that caused the error to their errors.
+	Fields map[string]string `json:"fields,omitempty"`
+	// Job is the ID of the onboarding job that the error concerns, if any.
+	Job string `json:"job,omitempty"`
 }
 
 func httpError(w http.ResponseWriter, msg string, code int) {
+	writeError(w, jsonError{Error: msg}, code)
+}
+
+// writeError writes the structured error with the given HTTP status code.
+func writeError(w http.ResponseWriter, e jsonError, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(jsonError{msg})
+	json.NewEncoder(w).Encode(e)
+}
+
+// ValueError is an error caused by a submitted value.
+type ValueError struct {
+	// Name is the name of the value.
+	Name string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("value %q: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error, so that it can be inspected with errors.Is and errors.As.
+func (e *ValueError) Unwrap() error {
+	return e.Err
+}
+
+// ValueErrors are errors caused by several submitted values.
+type ValueErrors []*ValueError
+
+// Error implements the error interface by joining the errors of all of the values.
+func (e ValueErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ve := range e {
+		msgs = append(msgs, ve.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// valueErrorResponse returns the structured error for an error caused by submitted values.
+// The first offending value is named in the error and all of them are listed in its fields.
+func valueErrorResponse(err error) jsonError {
+	e := jsonError{Error: err.Error(), Code: ErrorCodeInvalidValue}
+	var ves ValueErrors
+	var ve *ValueError
+	switch {
+	case errors.As(err, &ves) && len(ves) > 0:
+	case errors.As(err, &ve):
+		ves = ValueErrors{ve}
+	default:
+		return e
+	}
+	e.Value = ves[0].Name
+	e.Fields = make(map[string]string, len(ves))
+	for _, ve := range ves {
+		e.Fields[ve.Name] = ve.Err.Error()
+	}
+	return e
 }
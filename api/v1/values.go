@@ -0,0 +1,110 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type currentValuesResponse struct {
+	// Values are the current values by name.
+	Values map[string]string `json:"values"`
+	// Errors maps the names of the values whose current value could not be read to their errors.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// newCurrentValuesHandler serves the current values of the device, with which clients prefill inputs
+// when the device is onboarded again.
+func newCurrentValuesHandler(l log.Logger, o *Onboarding) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, jsonError{Error: "method not allowed", Code: ErrorCodeInvalidRequest}, http.StatusMethodNotAllowed)
+			return
+		}
+		res := currentValuesResponse{Values: make(map[string]string)}
+		if o.opts.CurrentValues != nil {
+			values, err := o.opts.CurrentValues(r.Context())
+			if values != nil {
+				res.Values = values
+			}
+			if err != nil {
+				level.Debug(l).Log("msg", "failed to read current values", "error", err.Error())
+				var ves ValueErrors
+				if !errors.As(err, &ves) {
+					writeError(w, jsonError{Error: err.Error(), Code: ErrorCodeInternal}, http.StatusInternalServerError)
+					return
+				}
+				res.Errors = make(map[string]string, len(ves))
+				for _, ve := range ves {
+					res.Errors[ve.Name] = ve.Err.Error()
+				}
+			}
+		}
+		buf, err := json.Marshal(res)
+		if err != nil {
+			msg := "failed to marshal current values"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
+
+type optionsResponse struct {
+	Options []string `json:"options"`
+}
+
+// newOptionsHandler serves the options of the select named by the path /api/v1/values/options/{name}.
+func newOptionsHandler(l log.Logger, o *Onboarding) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, jsonError{Error: "method not allowed", Code: ErrorCodeInvalidRequest}, http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/values/options/")
+		if o.opts.ListOptions == nil {
+			writeError(w, jsonError{Error: "value does not have dynamic options", Code: ErrorCodeNotFound, Value: name}, http.StatusNotFound)
+			return
+		}
+		options, err := o.opts.ListOptions(r.Context(), name)
+		if err != nil {
+			var ve *ValueError
+			if errors.As(err, &ve) {
+				writeError(w, jsonError{Error: err.Error(), Code: ErrorCodeNotFound, Value: name}, http.StatusNotFound)
+				return
+			}
+			level.Error(l).Log("msg", "failed to list options", "value", name, "error", err.Error())
+			writeError(w, jsonError{Error: err.Error(), Code: ErrorCodeInternal, Value: name}, http.StatusInternalServerError)
+			return
+		}
+		buf, err := json.Marshal(optionsResponse{Options: options})
+		if err != nil {
+			msg := "failed to marshal options"
+			level.Error(l).Log("msg", msg, "error", err.Error())
+			httpError(w, msg, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(buf)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// wifiEventsRetryInterval is the time to wait before following the journal again after a failure.
+	wifiEventsRetryInterval = 5 * time.Second
+	// wifiEventsHistory is the number of recent events that are sent to new subscribers.
+	wifiEventsHistory = 20
+)
+
+type wifiEventType string
+
+const (
+	connectedWiFiEventType           wifiEventType = "connected"
+	disconnectedWiFiEventType        wifiEventType = "disconnected"
+	wrongKeyWiFiEventType            wifiEventType = "wrong-key"
+	temporarilyDisabledWiFiEventType wifiEventType = "temporarily-disabled"
+	networkNotFoundWiFiEventType     wifiEventType = "network-not-found"
+	associationRejectedWiFiEventType wifiEventType = "association-rejected"
+	carrierGainedWiFiEventType       wifiEventType = "carrier-gained"
+	carrierLostWiFiEventType         wifiEventType = "carrier-lost"
+	addressAcquiredWiFiEventType     wifiEventType = "address-acquired"
+)
+
+type wifiEventSeverity string
+
+const (
+	infoWiFiEventSeverity    wifiEventSeverity = "info"
+	warningWiFiEventSeverity wifiEventSeverity = "warning"
+	errorWiFiEventSeverity   wifiEventSeverity = "error"
+)
+
+type wifiEvent struct {
+	Type     wifiEventType     `json:"type"`
+	Severity wifiEventSeverity `json:"severity"`
+	// Message is a human-friendly description of the event.
+	Message string `json:"message"`
+	// Raw is the log line from which the event was parsed.
+	Raw       string `json:"raw"`
+	Timestamp string `json:"timestamp"`
+}
+
+type wifiEventParser struct {
+	re    *regexp.Regexp
+	parse func([]string) *wifiEvent
+}
+
+// wifiEventParsers are tried in order; the first match wins.
+var wifiEventParsers = []wifiEventParser{
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-CONNECTED - Connection to ([0-9a-fA-F:]+) completed`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: connectedWiFiEventType, Severity: infoWiFiEventSeverity, Message: fmt.Sprintf("Connected to the wireless network via access point %s.", m[1])}
+		},
+	},
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-SSID-TEMP-DISABLED .*ssid="(.*)" auth_failures=\d+ duration=\d+ reason=WRONG_KEY`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: wrongKeyWiFiEventType, Severity: errorWiFiEventSeverity, Message: fmt.Sprintf("The password for the wireless network %q is incorrect.", m[1])}
+		},
+	},
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-SSID-TEMP-DISABLED .*ssid="(.*)" auth_failures=(\d+) duration=(\d+) reason=(\S+)`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: temporarilyDisabledWiFiEventType, Severity: warningWiFiEventSeverity, Message: fmt.Sprintf("Connecting to the wireless network %q failed %s times (%s); retrying in %s seconds.", m[1], m[2], m[4], m[3])}
+		},
+	},
+	{
+		re: regexp.MustCompile(`4-Way Handshake failed|WRONG_KEY`),
+		parse: func(_ []string) *wifiEvent {
+			return &wifiEvent{Type: wrongKeyWiFiEventType, Severity: errorWiFiEventSeverity, Message: "The wireless network password is incorrect."}
+		},
+	},
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-DISCONNECTED bssid=([0-9a-fA-F:]+) reason=(\d+)`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: disconnectedWiFiEventType, Severity: warningWiFiEventSeverity, Message: fmt.Sprintf("Disconnected from access point %s (reason %s).", m[1], m[2])}
+		},
+	},
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-NETWORK-NOT-FOUND`),
+		parse: func(_ []string) *wifiEvent {
+			return &wifiEvent{Type: networkNotFoundWiFiEventType, Severity: warningWiFiEventSeverity, Message: "The wireless network could not be found. Check the network name and that the device is in range."}
+		},
+	},
+	{
+		re: regexp.MustCompile(`CTRL-EVENT-ASSOC-REJECT bssid=([0-9a-fA-F:]+) status_code=(\d+)`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: associationRejectedWiFiEventType, Severity: errorWiFiEventSeverity, Message: fmt.Sprintf("Access point %s rejected the connection (status %s).", m[1], m[2])}
+		},
+	},
+	{
+		re: regexp.MustCompile(`Gained carrier`),
+		parse: func(_ []string) *wifiEvent {
+			return &wifiEvent{Type: carrierGainedWiFiEventType, Severity: infoWiFiEventSeverity, Message: "The wireless link is up."}
+		},
+	},
+	{
+		re: regexp.MustCompile(`Lost carrier`),
+		parse: func(_ []string) *wifiEvent {
+			return &wifiEvent{Type: carrierLostWiFiEventType, Severity: warningWiFiEventSeverity, Message: "The wireless link is down."}
+		},
+	},
+	{
+		re: regexp.MustCompile(`DHCPv4 address ([0-9.]+/\d+)`),
+		parse: func(m []string) *wifiEvent {
+			return &wifiEvent{Type: addressAcquiredWiFiEventType, Severity: infoWiFiEventSeverity, Message: fmt.Sprintf("Received address %s from the DHCP server.", m[1])}
+		},
+	},
+}
+
+// parseWiFiEvent parses a log message into an event.
+// If the message is not recognized, then nil is returned.
+func parseWiFiEvent(msg string) *wifiEvent {
+	for _, p := range wifiEventParsers {
+		if m := p.re.FindStringSubmatch(msg); m != nil {
+			e := p.parse(m)
+			e.Raw = msg
+			return e
+		}
+	}
+	return nil
+}
+
+// WiFiEvents follows the wpa_supplicant and systemd-networkd logs
+// and parses known messages into structured events.
+type WiFiEvents struct {
+	l       log.Logger
+	lr      logReader
+	counter *prometheus.CounterVec
+
+	mu          sync.Mutex
+	recent      []*wifiEvent
+	subscribers map[chan *wifiEvent]struct{}
+}
+
+// NewWiFiEvents creates a new WiFiEvents for the given WLAN interface.
+func NewWiFiEvents(r prometheus.Registerer, l log.Logger, wlanInterface string) *WiFiEvents {
+	w := &WiFiEvents{
+		l: l,
+		// Only new messages are of interest, since old ones were either
+		// already counted or are from before Onboard started.
+		lr: logReaderForMatcher("--lines=0",
+			fmt.Sprintf("SYSLOG_IDENTIFIER=wpa_supplicant@%s", wlanInterface),
+			"+",
+			"SYSLOG_IDENTIFIER=systemd-networkd", fmt.Sprintf("INTERFACE=%s", wlanInterface),
+		),
+		counter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "onboard_wifi_events_total",
+				Help: "The number of Wi-Fi events parsed from the logs.",
+			},
+			[]string{"type", "severity"},
+		),
+		subscribers: make(map[chan *wifiEvent]struct{}),
+	}
+	if r != nil {
+		r.MustRegister(w.counter)
+	}
+	return w
+}
+
+// Run follows the logs until the given context is cancelled.
+func (w *WiFiEvents) Run(ctx context.Context) error {
+	for {
+		if err := w.follow(ctx); err != nil && ctx.Err() == nil {
+			level.Warn(w.l).Log("msg", "failed to follow Wi-Fi logs", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wifiEventsRetryInterval):
+		}
+	}
+}
+
+func (w *WiFiEvents) follow(ctx context.Context) error {
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := w.lr(ctx, pw)
+		pw.CloseWithError(err)
+		errCh <- err
+	}()
+	s := bufio.NewScanner(pr)
+	for s.Scan() {
+		var entry struct {
+			Message   string `json:"MESSAGE"`
+			Timestamp string `json:"__REALTIME_TIMESTAMP"`
+		}
+		// Messages that are not valid UTF-8 are encoded as arrays and are skipped.
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			continue
+		}
+		e := parseWiFiEvent(entry.Message)
+		if e == nil {
+			continue
+		}
+		e.Timestamp = entry.Timestamp
+		w.publish(e)
+	}
+	pr.Close()
+	if err := <-errCh; err != nil {
+		return err
+	}
+	return s.Err()
+}
+
+func (w *WiFiEvents) publish(e *wifiEvent) {
+	w.counter.WithLabelValues(string(e.Type), string(e.Severity)).Inc()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recent = append(w.recent, e)
+	if len(w.recent) > wifiEventsHistory {
+		w.recent = w.recent[len(w.recent)-wifiEventsHistory:]
+	}
+	for ch := range w.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// Drop events for subscribers that are not keeping up
+			// rather than blocking the log reader.
+		}
+	}
+}
+
+// subscribe returns the recent events and a channel on which new events will be sent.
+// The returned function must be called to unsubscribe.
+func (w *WiFiEvents) subscribe() ([]*wifiEvent, <-chan *wifiEvent, func()) {
+	ch := make(chan *wifiEvent, wifiEventsHistory)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers[ch] = struct{}{}
+	recent := make([]*wifiEvent, len(w.recent))
+	copy(recent, w.recent)
+	return recent, ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subscribers, ch)
+	}
+}
+
+func newWiFiEventsHandler(l log.Logger, w *WiFiEvents) func(http.ResponseWriter, *http.Request) {
+	return sseMiddleware(func(rw http.ResponseWriter, r *http.Request) {
+		sw := &sseWriter{rw.(http.Flusher), rw}
+		recent, ch, unsubscribe := w.subscribe()
+		defer unsubscribe()
+		write := func(e *wifiEvent) bool {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				level.Error(l).Log("msg", "failed to marshal event", "error", err.Error())
+				return false
+			}
+			_, err = sw.Write(buf)
+			return err == nil
+		}
+		for _, e := range recent {
+			if !write(e) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-ch:
+				if !write(e) {
+					return
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// These constants are taken from include/uapi/linux/nl80211.h.
+const (
+	nl80211FamilyName = "nl80211"
+
+	nl80211CmdGetInterface = 5
+	nl80211CmdGetStation   = 17
+
+	nl80211AttrIfindex   = 3
+	nl80211AttrMAC       = 6
+	nl80211AttrStaInfo   = 21
+	nl80211AttrWiphyFreq = 38
+	nl80211AttrSSID      = 52
+
+	nl80211StaInfoSignal    = 7
+	nl80211StaInfoTxBitrate = 8
+	nl80211StaInfoRxBitrate = 14
+
+	nl80211RateInfoBitrate   = 1
+	nl80211RateInfoBitrate32 = 5
+
+	// nlaTypeMask strips the nested and byte order flags from an attribute type.
+	nlaTypeMask = ^uint16(nl.NLA_F_NESTED | 1<<14)
+)
+
+// errNotAssociated is returned when the wireless interface is not connected to an access point.
+var errNotAssociated = errors.New("interface is not associated")
+
+type wirelessResponse struct {
+	SSID  string `json:"ssid"`
+	BSSID string `json:"bssid"`
+	// Frequency is the frequency of the channel in MHz.
+	Frequency int `json:"frequency"`
+	Channel   int `json:"channel"`
+	// Signal is the signal strength of the access point in dBm.
+	Signal int `json:"signal"`
+	// TxBitrate is the transmit bitrate in bits per second.
+	TxBitrate int `json:"txBitrate"`
+	// RxBitrate is the receive bitrate in bits per second.
+	RxBitrate int `json:"rxBitrate"`
+}
+
+// nl80211Request executes a request against the nl80211 generic netlink family
+// and returns the attributes of every message in the response.
+func nl80211Request(cmd uint8, flags, ifindex int) ([][]syscall.NetlinkRouteAttr, error) {
+	f, err := netlink.GenlFamilyGet(nl80211FamilyName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s family: %w", nl80211FamilyName, err)
+	}
+	req := nl.NewNetlinkRequest(int(f.ID), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: uint8(f.Version)})
+	req.AddData(nl.NewRtAttr(nl80211AttrIfindex, nl.Uint32Attr(uint32(ifindex))))
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute %s request: %w", nl80211FamilyName, err)
+	}
+	attrs := make([][]syscall.NetlinkRouteAttr, 0, len(msgs))
+	for _, m := range msgs {
+		as, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s response: %w", nl80211FamilyName, err)
+		}
+		attrs = append(attrs, as)
+	}
+	return attrs, nil
+}
+
+// wirelessStatus returns information about the access point that the given interface is associated with.
+// If the interface is not associated, then errNotAssociated is returned.
+func wirelessStatus(ifindex int) (*wirelessResponse, error) {
+	var wr wirelessResponse
+	interfaces, err := nl80211Request(nl80211CmdGetInterface, 0, ifindex)
+	if err != nil {
+		return nil, err
+	}
+	native := nl.NativeEndian()
+	for _, as := range interfaces {
+		for _, a := range as {
+			switch a.Attr.Type & nlaTypeMask {
+			case nl80211AttrSSID:
+				wr.SSID = string(a.Value)
+			case nl80211AttrWiphyFreq:
+				wr.Frequency = int(native.Uint32(a.Value))
+				wr.Channel = channel(wr.Frequency)
+			}
+		}
+	}
+	if wr.SSID == "" {
+		return nil, errNotAssociated
+	}
+
+	stations, err := nl80211Request(nl80211CmdGetStation, syscall.NLM_F_DUMP, ifindex)
+	if err != nil {
+		return nil, err
+	}
+	if len(stations) == 0 {
+		return nil, errNotAssociated
+	}
+	// A station interface only has a single peer: the access point.
+	for _, a := range stations[0] {
+		switch a.Attr.Type & nlaTypeMask {
+		case nl80211AttrMAC:
+			wr.BSSID = net.HardwareAddr(a.Value).String()
+		case nl80211AttrStaInfo:
+			info, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse station info: %w", err)
+			}
+			for _, i := range info {
+				switch i.Attr.Type & nlaTypeMask {
+				case nl80211StaInfoSignal:
+					wr.Signal = int(int8(i.Value[0]))
+				case nl80211StaInfoTxBitrate:
+					if wr.TxBitrate, err = bitrate(i.Value); err != nil {
+						return nil, err
+					}
+				case nl80211StaInfoRxBitrate:
+					if wr.RxBitrate, err = bitrate(i.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return &wr, nil
+}
+
+// bitrate parses a nested rate info attribute into bits per second.
+func bitrate(b []byte) (int, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse rate info: %w", err)
+	}
+	native := nl.NativeEndian()
+	var rate int
+	for _, a := range attrs {
+		switch a.Attr.Type & nlaTypeMask {
+		// The 32 bit bitrate takes precedence over the 16 bit bitrate, which can overflow.
+		case nl80211RateInfoBitrate32:
+			return int(native.Uint32(a.Value)) * 100 * 1000, nil
+		case nl80211RateInfoBitrate:
+			rate = int(native.Uint16(a.Value)) * 100 * 1000
+		}
+	}
+	return rate, nil
+}
+
+// channel converts a frequency in MHz into an IEEE 802.11 channel number.
+func channel(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5000 && freq < 5950:
+		return (freq - 5000) / 5
+	case freq >= 5950 && freq <= 7125:
+		return (freq - 5950) / 5
+	}
+	return 0
+}
@@ -0,0 +1,423 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	flag "github.com/spf13/pflag"
+
+	v1 "github.com/squat/onboard/api/v1"
+)
+
+// jobPollInterval is the amount of time to wait between polls of a running onboarding job.
+const jobPollInterval = time.Second
+
+// readValues reads values from a YAML or JSON file.
+func readValues(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %w", path, err)
+	}
+	values, err := parseValues(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read values from file %q: %w", path, err)
+	}
+	return values, nil
+}
+
+// parseValues parses YAML or JSON values.
+// Scalar values are converted to strings.
+func parseValues(data []byte) (map[string]string, error) {
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch t := v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("value %q must be a scalar", k)
+		case nil:
+			values[k] = ""
+		case float64:
+			// Numbers are decoded as floats, which must not be printed in exponent notation.
+			values[k] = strconv.FormatFloat(t, 'f', -1, 64)
+		default:
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// client is a client for the Onboard API of a device.
+type client struct {
+	endpoint string
+	c        *http.Client
+	// token is the session token obtained by pairing, if any.
+	token string
+}
+
+// pair pairs with the device using the given PIN and uses the resulting session for all further requests.
+func (c *client) pair(pin string) error {
+	body, err := json.Marshal(map[string]string{"pin": pin})
+	if err != nil {
+		return err
+	}
+	var pr struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(http.MethodPost, "/api/v1/pair", body, &pr); err != nil {
+		return fmt.Errorf("failed to pair with device: %w", err)
+	}
+	c.token = pr.Token
+	return nil
+}
+
+// do executes a request against the API and decodes the JSON response into out, if it is not nil.
+func (c *client) do(method, path string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.endpoint, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &e); err == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// encryptSecrets returns a copy of the values in which the secret values
+// are encrypted with the key published by the device.
+func (c *client) encryptSecrets(cfg *config, values map[string]string) (map[string]string, error) {
+	var pc struct {
+		EncryptionKey *encryptionKey `json:"encryptionKey"`
+	}
+	if err := c.do(http.MethodGet, "/api/v1/config", nil, &pc); err != nil {
+		return nil, fmt.Errorf("failed to get encryption key from device: %w", err)
+	}
+	encrypted := make(map[string]string, len(values))
+	for k, v := range values {
+		encrypted[k] = v
+	}
+	var pub *rsa.PublicKey
+	for _, v := range cfg.Values {
+		if !v.Secret {
+			continue
+		}
+		if pub == nil {
+			if pc.EncryptionKey == nil {
+				return nil, errors.New("device did not publish an encryption key for secret values")
+			}
+			var err error
+			if pub, err = pc.EncryptionKey.publicKey(); err != nil {
+				return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+			}
+		}
+		e, err := encryptValue(pub, values[v.Name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt value %q: %w", v.Name, err)
+		}
+		encrypted[v.Name] = e
+	}
+	return encrypted, nil
+}
+
+// clientCheck is a check that is run against the device's API after onboarding,
+// mirroring the checks that the webapp runs.
+type clientCheck struct {
+	name  string
+	check func(*client) (bool, error)
+}
+
+func clientChecks(cfg *config, values map[string]string) []clientCheck {
+	type linkResponse struct {
+		Addresses []string `json:"addresses"`
+		State     string   `json:"state"`
+	}
+	checks := []clientCheck{
+		{
+			name: "Bringing Up Network",
+			check: func(c *client) (bool, error) {
+				var lr linkResponse
+				if err := c.do(http.MethodGet, "/api/v1/status/link", nil, &lr); err != nil {
+					return false, err
+				}
+				return lr.State == "up", nil
+			},
+		},
+		{
+			name: "Getting IP Address",
+			check: func(c *client) (bool, error) {
+				var lr linkResponse
+				if err := c.do(http.MethodGet, "/api/v1/status/link", nil, &lr); err != nil {
+					return false, err
+				}
+				return len(lr.Addresses) != 0, nil
+			},
+		},
+	}
+	for _, ch := range cfg.Checks {
+		ch := ch
+		switch {
+		case ch.DNS != nil:
+			checks = append(checks, clientCheck{
+				name: "Testing DNS",
+				check: func(c *client) (bool, error) {
+					if err := c.do(http.MethodGet, "/api/v1/status/dns?"+url.Values{"endpoint": {values[ch.DNS.Value]}}.Encode(), nil, nil); err != nil {
+						return false, err
+					}
+					return true, nil
+				},
+			})
+		case ch.Systemd != nil:
+			checks = append(checks, clientCheck{
+				name: ch.Systemd.Description,
+				check: func(c *client) (bool, error) {
+					var sr struct {
+						Result   string `json:"result"`
+						SubState string `json:"subState"`
+					}
+					if err := c.do(http.MethodGet, "/api/v1/status/systemd?"+url.Values{"unit": {ch.Systemd.Unit}}.Encode(), nil, &sr); err != nil {
+						return false, err
+					}
+					return sr.Result == "success" && sr.SubState == "dead", nil
+				},
+			})
+		}
+	}
+	return checks
+}
+
+func apply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "http://onboard.local", "The URL of the device to onboard.")
+	valuesPath := fs.StringP("values", "f", "", "The path to a YAML or JSON file containing the values to submit.")
+	tries := fs.Int("check.tries", 10, "The number of times to try each check before giving up.")
+	interval := fs.Duration("check.interval", 5*time.Second, "The amount of time to wait between tries of a check.")
+	timeout := fs.Duration("timeout", 30*time.Second, "The timeout for each request to the device.")
+	root := fs.String("root", "", "The path at which the root filesystem of a device image is mounted. If set, the actions are applied to the image rather than submitted to a device, and checks are skipped.")
+	pin := fs.String("pin", "", "The pairing PIN of the device, if it requires pairing.")
+	paths := fs.StringArrayP("config", "c", nil, "The path to the configuration file to apply when --root is set. Can be specified multiple times and can be a glob. Defaults to /etc/onboard/*.yaml inside of the root.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *valuesPath == "" {
+		return errors.New("the path to a values file must be specified")
+	}
+
+	values, err := readValues(*valuesPath)
+	if err != nil {
+		return err
+	}
+
+	if *root != "" {
+		if len(*paths) == 0 {
+			// The configuration files in an image are usually
+			// absolute symlinks, which must be resolved inside of the root.
+			matches, err := filepath.Glob(filepath.Join(*root, "etc/onboard/*.yaml"))
+			if err != nil {
+				return err
+			}
+			for _, m := range matches {
+				resolved, err := resolveInRoot(*root, strings.TrimPrefix(m, *root))
+				if err != nil {
+					return fmt.Errorf("failed to resolve configuration file %q: %w", m, err)
+				}
+				*paths = append(*paths, filepath.Join(*root, resolved))
+			}
+		}
+		cfg, err := loadConfig(*paths)
+		if err != nil {
+			return err
+		}
+		// Facts about the device are not available offline,
+		// so only defaults and computed values that do not refer to them can be used.
+		if err := cfg.complete(values); err != nil {
+			return fmt.Errorf("values file %q is invalid: %w", *valuesPath, err)
+		}
+		if err := cfg.validateValues(values); err != nil {
+			return fmt.Errorf("values file %q is invalid: %w", *valuesPath, err)
+		}
+		if err := applyOffline(*root, cfg, values); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, "image onboarded")
+		return nil
+	}
+
+	c := &client{endpoint: *endpoint, c: &http.Client{Timeout: *timeout}}
+	if *pin != "" {
+		if err := c.pair(*pin); err != nil {
+			return err
+		}
+	}
+	cfg := &config{}
+	if err := c.do(http.MethodGet, "/api/v1/config", nil, cfg); err != nil {
+		return fmt.Errorf("failed to get configuration from device: %w", err)
+	}
+	if err := submitValues(os.Stdout, c, cfg, values, *tries, *interval); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, "device onboarded")
+	return nil
+}
+
+// submitValues validates the values against the configuration, submits them to the device,
+// and then runs the checks, writing a report of the results to w.
+func submitValues(w io.Writer, c *client, cfg *config, values map[string]string, tries int, interval time.Duration) error {
+	if err := cfg.validateValues(values); err != nil {
+		return fmt.Errorf("values are invalid: %w", err)
+	}
+	encrypted, err := c.encryptSecrets(cfg, values)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to marshal values: %w", err)
+	}
+	var jr struct {
+		Job string `json:"job"`
+	}
+	if err := c.do(http.MethodPost, "/api/v1/onboard", body, &jr); err != nil {
+		return fmt.Errorf("failed to onboard device: %w", err)
+	}
+	fmt.Fprintf(w, "submitted values as job %s\n", jr.Job)
+	if err := waitForJob(w, c, jr.Job, tries, interval); err != nil {
+		return err
+	}
+	return runChecks(w, c, clientChecks(cfg, values), tries, interval)
+}
+
+// waitForJob polls the onboarding job with the given ID until it finishes,
+// writing a report of the result of every action to w.
+// Errors are retried up to the given number of times in a row,
+// since the device may change networks while the actions run.
+func waitForJob(w io.Writer, c *client, id string, tries int, interval time.Duration) error {
+	reported := 0
+	failures := 0
+	for {
+		var job v1.Job
+		if err := c.do(http.MethodGet, "/api/v1/jobs/"+url.PathEscape(id), nil, &job); err != nil {
+			if failures++; failures >= tries {
+				return fmt.Errorf("failed to get onboarding job: %w", err)
+			}
+			time.Sleep(interval)
+			continue
+		}
+		failures = 0
+		for ; reported < len(job.Actions); reported++ {
+			a := job.Actions[reported]
+			if a.Deferred && a.State == v1.ActionStatePending && job.State == v1.JobStateSucceeded {
+				fmt.Fprintf(w, "[deferred] %s\n", a.Name)
+				continue
+			}
+			if a.State == v1.ActionStatePending || a.State == v1.ActionStateRunning {
+				break
+			}
+			fmt.Fprintf(w, "[%s] %s", a.State, a.Name)
+			if a.State != v1.ActionStateSkipped {
+				fmt.Fprintf(w, " (%s)", time.Duration(a.Duration*float64(time.Second)).Round(time.Millisecond))
+			}
+			fmt.Fprintln(w)
+			if a.Error != "" {
+				fmt.Fprintf(w, "  error: %s\n", a.Error)
+			}
+			if a.State == v1.ActionStateFailed && a.Output != "" {
+				fmt.Fprintf(w, "  output:\n    %s\n", strings.ReplaceAll(strings.TrimSpace(a.Output), "\n", "\n    "))
+			}
+		}
+		switch job.State {
+		case v1.JobStateSucceeded:
+			return nil
+		case v1.JobStateFailed:
+			return fmt.Errorf("failed to onboard device: %s", job.Error)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// runChecks runs the given checks in order, trying each check up to the given number of times,
+// and writes a report of the results to w.
+// It stops at the first check that fails.
+func runChecks(w io.Writer, c *client, checks []clientCheck, tries int, interval time.Duration) error {
+	for _, ch := range checks {
+		var ok bool
+		var err error
+		for i := 0; i < tries; i++ {
+			if i != 0 {
+				time.Sleep(interval)
+			}
+			// Errors are expected while the device changes networks, so retry them.
+			if ok, err = ch.check(c); ok {
+				break
+			}
+		}
+		if !ok {
+			fmt.Fprintf(w, "[failed] %s\n", ch.name)
+			if err != nil {
+				return fmt.Errorf("check %q failed: %w", ch.name, err)
+			}
+			return fmt.Errorf("check %q failed after %d tries", ch.name, tries)
+		}
+		fmt.Fprintf(w, "[ok] %s\n", ch.name)
+	}
+	return nil
+}
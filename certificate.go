@@ -0,0 +1,293 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// CertificateAction is an action that creates a private key and a certificate signing request (CSR).
+// All fields of the subject and the subject alternative names are Golang templates
+// that are rendered with the values collected by Onboard.
+type CertificateAction struct {
+	// Key is the path at which the private key is written.
+	// If a key already exists at the path, it is reused.
+	Key string `json:"key"`
+	// CSR is the path at which the PEM-encoded CSR is written.
+	CSR string `json:"csr"`
+	// Subject is the subject of the CSR.
+	Subject CertificateSubject `json:"subject"`
+	// DNSNames are the DNS subject alternative names of the CSR.
+	// Names that render to an empty string are omitted.
+	DNSNames []string `json:"dnsNames"`
+	// IPAddresses are the IP subject alternative names of the CSR.
+	// Addresses that render to an empty string are omitted.
+	IPAddresses []string `json:"ipAddresses"`
+	// Submit optionally submits the CSR to an HTTP endpoint to be signed.
+	Submit *CertificateSubmit `json:"submit"`
+	// cfg is the configuration, whose values and facts are used when rendering the templates.
+	cfg *config
+}
+
+// CertificateSubject is the subject of a CSR.
+type CertificateSubject struct {
+	CommonName         string   `json:"commonName"`
+	Organization       []string `json:"organization"`
+	OrganizationalUnit []string `json:"organizationalUnit"`
+	Country            []string `json:"country"`
+	Province           []string `json:"province"`
+	Locality           []string `json:"locality"`
+}
+
+// CertificateSubmit configures the submission of a CSR to an HTTP endpoint.
+// The PEM-encoded CSR is POSTed to the URL and signed with the device's identity.
+// The endpoint must respond with the PEM-encoded certificate.
+type CertificateSubmit struct {
+	// URL is the URL to which the CSR is POSTed.
+	URL string `json:"url"`
+	// Certificate is the path at which the certificate returned by the endpoint is written.
+	Certificate string `json:"certificate"`
+}
+
+// templates returns all of the templates of the action, keyed by a human-friendly name.
+func (c *CertificateAction) templates() map[string]string {
+	t := map[string]string{"subject.commonName": c.Subject.CommonName}
+	for name, list := range map[string][]string{
+		"subject.organization":       c.Subject.Organization,
+		"subject.organizationalUnit": c.Subject.OrganizationalUnit,
+		"subject.country":            c.Subject.Country,
+		"subject.province":           c.Subject.Province,
+		"subject.locality":           c.Subject.Locality,
+		"dnsNames":                   c.DNSNames,
+		"ipAddresses":                c.IPAddresses,
+	} {
+		for i, s := range list {
+			t[fmt.Sprintf("%s[%d]", name, i)] = s
+		}
+	}
+	return t
+}
+
+func (c *CertificateAction) validate(cfg *config) error {
+	var errs []string
+	c.cfg = cfg
+	if len(c.Key) == 0 {
+		errs = append(errs, "certificate key path cannot be empty")
+	}
+	if len(c.CSR) == 0 {
+		errs = append(errs, "certificate CSR path cannot be empty")
+	}
+	for name, text := range c.templates() {
+		if _, err := template.New(name).Parse(text); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to parse template for %s: %v", name, err))
+		}
+	}
+	if c.Submit != nil {
+		if u, err := url.Parse(c.Submit.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("certificate submit URL %q must be an http or https URL", c.Submit.URL))
+		}
+		if len(c.Submit.Certificate) == 0 {
+			errs = append(errs, "certificate submit path cannot be empty")
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *CertificateAction) action(ident *identity) func(context.Context, map[string]string, io.Writer) error {
+	return func(ctx context.Context, values map[string]string, out io.Writer) error {
+		data := c.cfg.templateData(values)
+		render := func(texts []string) ([]string, error) {
+			var out []string
+			for _, text := range texts {
+				s, err := renderTemplate(text, data)
+				if err != nil {
+					return nil, err
+				}
+				if s != "" {
+					out = append(out, s)
+				}
+			}
+			return out, nil
+		}
+		cn, err := renderTemplate(c.Subject.CommonName, data)
+		if err != nil {
+			return err
+		}
+		tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}
+		var ips []string
+		for _, f := range []struct {
+			dst *[]string
+			src []string
+		}{
+			{&tmpl.Subject.Organization, c.Subject.Organization},
+			{&tmpl.Subject.OrganizationalUnit, c.Subject.OrganizationalUnit},
+			{&tmpl.Subject.Country, c.Subject.Country},
+			{&tmpl.Subject.Province, c.Subject.Province},
+			{&tmpl.Subject.Locality, c.Subject.Locality},
+			{&tmpl.DNSNames, c.DNSNames},
+			{&ips, c.IPAddresses},
+		} {
+			if *f.dst, err = render(f.src); err != nil {
+				return err
+			}
+		}
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("%q is not a valid IP address", s)
+			}
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+
+		key, err := loadOrCreateCertificateKey(c.Key)
+		if err != nil {
+			return err
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+		if err != nil {
+			return fmt.Errorf("failed to create CSR: %w", err)
+		}
+		csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+		if err := writeFile(c.CSR, csr, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "wrote CSR to %s\n", c.CSR)
+		if c.Submit == nil {
+			return nil
+		}
+		cert, err := submitCSR(ctx, c.Submit.URL, csr, ident)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(c.Submit.Certificate, cert, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "wrote certificate to %s\n", c.Submit.Certificate)
+		return nil
+	}
+}
+
+// renderTemplate renders the given Golang template with the given template data.
+func renderTemplate(text string, data map[string]interface{}) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// loadOrCreateCertificateKey loads the private key at the given path,
+// generating and saving a new ECDSA P-256 key if none exists.
+func loadOrCreateCertificateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode PEM in key file %q", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file %q: %w", path, err)
+		}
+		key, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key file %q does not contain a signing key", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read key file %q: %w", path, err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := writeKey(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// submitCSR POSTs the PEM-encoded CSR to the given URL, signed with the device's identity,
+// and returns the PEM-encoded certificate from the response.
+func submitCSR(ctx context.Context, u string, csr []byte, ident *identity) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(csr))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Accept", "application/x-pem-file")
+	req.Header.Set(signatureHeader, ident.sign(csr))
+	req.Header.Set(publicKeyHeader, base64.StdEncoding.EncodeToString(ident.publicKey()))
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit CSR: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("CSR endpoint responded with %s", res.Status)
+	}
+	cert, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	block, _ := pem.Decode(cert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("CSR endpoint did not respond with a PEM-encoded certificate")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// writeFile writes the file, creating any missing parent directories.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for file %q: %w", path, err)
+	}
+	if err := ioutil.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write file %q: %w", path, err)
+	}
+	return nil
+}
@@ -15,16 +15,32 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"unicode/utf8"
+
+	"github.com/ghodss/yaml"
+
+	v1 "github.com/squat/onboard/api/v1"
 )
 
+// factsKey is the key of the facts about the device in the data of templates.
+const factsKey = "Facts"
+
 var validName = regexp.MustCompile(`^[a-zA-Z_]+[a-zA-Z0-9_-]*$`)
 var validUnitName = regexp.MustCompile(`^([a-zA-Z0-9:._-]+@)?[a-zA-Z0-9:._-]+(\.service|\.socket|\.device|\.mount|\.automount|\.swap|\.target|\.path|\.timer|\.slice|\.scope)$`)
 
@@ -53,6 +69,14 @@ type Action struct {
 	File *FileAction `json:"file"`
 	// Systemd is an action that performs an operation on a systemd unit.
 	Systemd *SystemdAction `json:"systemd"`
+	// Certificate is an action that creates a private key and a certificate signing request.
+	Certificate *CertificateAction `json:"certificate"`
+	// Power is an action that reboots or powers off the device. It is always deferred.
+	Power *PowerAction `json:"power"`
+	// Deferred marks the action as disruptive, e.g. because it restarts the network.
+	// Deferred actions run after all other actions have succeeded
+	// and clients have had time to receive the result of onboarding.
+	Deferred bool `json:"deferred"`
 }
 
 func (a *Action) validate(cfg *config) error {
@@ -66,7 +90,7 @@ func (a *Action) validate(cfg *config) error {
 	n := 0
 	if a.File != nil {
 		n++
-		if err := a.File.validate(cfg.Values); err != nil {
+		if err := a.File.validate(cfg); err != nil {
 			errs = append(errs, fmt.Sprintf("action %q: %v", a.Name, err))
 		}
 	}
@@ -76,8 +100,20 @@ func (a *Action) validate(cfg *config) error {
 			errs = append(errs, fmt.Sprintf("action %q: %v", a.Name, err))
 		}
 	}
+	if a.Certificate != nil {
+		n++
+		if err := a.Certificate.validate(cfg); err != nil {
+			errs = append(errs, fmt.Sprintf("action %q: %v", a.Name, err))
+		}
+	}
+	if a.Power != nil {
+		n++
+		if err := a.Power.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("action %q: %v", a.Name, err))
+		}
+	}
 	if n != 1 {
-		errs = append(errs, fmt.Sprintf("action %q: exactly one of 'file' must be specified", a.Name))
+		errs = append(errs, fmt.Sprintf("action %q: exactly one of 'file', 'systemd', 'certificate', or 'power' must be specified", a.Name))
 	}
 	if len(errs) > 0 {
 		return errors.New(strings.Join(errs, "; "))
@@ -85,16 +121,29 @@ func (a *Action) validate(cfg *config) error {
 	return nil
 }
 
-func (a *Action) action() func(map[string]string) error {
+// action returns a function that performs the action.
+// Actions that make authenticated requests use the given identity.
+func (a *Action) action(ident *identity) func(context.Context, map[string]string, io.Writer) error {
 	if a.File != nil {
 		return a.File.action()
 	}
 	if a.Systemd != nil {
 		return a.Systemd.action()
 	}
+	if a.Certificate != nil {
+		return a.Certificate.action(ident)
+	}
+	if a.Power != nil {
+		return a.Power.action()
+	}
 	return nil
 }
 
+// deferred returns whether the action must run after all other actions.
+func (a *Action) deferred() bool {
+	return a.Deferred || a.Power != nil
+}
+
 // FileAction is an action that provisions a file, either from a literal value or based on a template.
 type FileAction struct {
 	// Path is the location on disk where the file should ultimately be written.
@@ -107,13 +156,16 @@ type FileAction struct {
 	// This field is mutually exclusive with `Value`.
 	Template *string `json:"template"`
 	t        *template.Template
+	// cfg is the configuration, whose values and facts are used when rendering the template.
+	cfg *config
 }
 
-func (f *FileAction) validate(values []*Value) error {
+func (f *FileAction) validate(cfg *config) error {
 	var errs []string
 	if len(f.Path) == 0 {
 		return errors.New("file path cannot be empty")
 	}
+	f.cfg = cfg
 	n := 0
 	if f.Value != nil {
 		n++
@@ -121,7 +173,7 @@ func (f *FileAction) validate(values []*Value) error {
 			errs = append(errs, "file value must point at a defined value")
 		}
 		var found bool
-		for _, v := range values {
+		for _, v := range cfg.Values {
 			if v.Name == *f.Value {
 				found = true
 				break
@@ -152,20 +204,25 @@ func (f *FileAction) validate(values []*Value) error {
 	return nil
 }
 
-func (f *FileAction) action() func(map[string]string) error {
+func (f *FileAction) action() func(context.Context, map[string]string, io.Writer) error {
+	return f.actionAt(f.Path)
+}
+
+// actionAt returns a function that provisions the file at the given path rather than at the configured path.
+func (f *FileAction) actionAt(path string) func(context.Context, map[string]string, io.Writer) error {
 	if f.Value != nil {
-		return func(values map[string]string) error {
-			return ioutil.WriteFile(f.Path, []byte(values[*f.Value]), 0644)
+		return func(_ context.Context, values map[string]string, _ io.Writer) error {
+			return ioutil.WriteFile(path, []byte(values[*f.Value]), 0644)
 		}
 	}
 	if f.Template != nil {
-		return func(values map[string]string) error {
-			file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		return func(_ context.Context, values map[string]string, _ io.Writer) error {
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 			if err != nil {
-				return fmt.Errorf("failed to open file %q: %w", f.Path, err)
+				return fmt.Errorf("failed to open file %q: %w", path, err)
 			}
 			defer file.Close()
-			if err := f.t.Execute(file, values); err != nil {
+			if err := f.t.Execute(file, f.cfg.templateData(values)); err != nil {
 				return fmt.Errorf("failed to execute template: %w", err)
 			}
 			return nil
@@ -211,15 +268,56 @@ func (s *SystemdAction) validate() error {
 	return nil
 }
 
-func (s *SystemdAction) action() func(map[string]string) error {
-	return func(_ map[string]string) error {
-		if err := exec.Command("systemctl", string(s.Command), s.Unit).Run(); err != nil {
+func (s *SystemdAction) action() func(context.Context, map[string]string, io.Writer) error {
+	return func(ctx context.Context, _ map[string]string, out io.Writer) error {
+		cmd := exec.CommandContext(ctx, "systemctl", string(s.Command), s.Unit)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to execute systemd action: %w", err)
 		}
 		return nil
 	}
 }
 
+// PowerCommand is a valid power command.
+type PowerCommand string
+
+const (
+	// PowerCommandReboot reboots the device.
+	PowerCommandReboot PowerCommand = "reboot"
+	// PowerCommandPoweroff powers off the device.
+	PowerCommandPoweroff PowerCommand = "poweroff"
+)
+
+// PowerAction is an action that reboots or powers off the device once onboarding has finished.
+type PowerAction struct {
+	// Command is the power command that should be executed.
+	Command PowerCommand `json:"command"`
+}
+
+func (p *PowerAction) validate() error {
+	switch p.Command {
+	case PowerCommandReboot:
+	case PowerCommandPoweroff:
+	default:
+		return fmt.Errorf("power command must be one of: %s", strings.Join([]string{string(PowerCommandReboot), string(PowerCommandPoweroff)}, ","))
+	}
+	return nil
+}
+
+func (p *PowerAction) action() func(context.Context, map[string]string, io.Writer) error {
+	return func(ctx context.Context, _ map[string]string, out io.Writer) error {
+		cmd := exec.CommandContext(ctx, "systemctl", string(p.Command))
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to execute power action: %w", err)
+		}
+		return nil
+	}
+}
+
 // Check represents a validation operation that Onboard should perform once all actions have been executed.
 type Check struct {
 	// Name is a unique name for the check. It must be unique
@@ -329,6 +427,24 @@ func (g *GRPCCheck) validate() error {
 	return nil
 }
 
+// ValueType is a valid type of value.
+type ValueType string
+
+const (
+	// ValueTypeString is a single line of text.
+	ValueTypeString ValueType = "string"
+	// ValueTypeBool is a boolean, i.e. "true" or "false".
+	ValueTypeBool ValueType = "bool"
+	// ValueTypeInt is a decimal integer.
+	ValueTypeInt ValueType = "int"
+	// ValueTypeSelect is one of a list of options.
+	ValueTypeSelect ValueType = "select"
+	// ValueTypeMultiline is text that can span several lines.
+	ValueTypeMultiline ValueType = "multiline"
+	// ValueTypeFile is the contents of an uploaded file.
+	ValueTypeFile ValueType = "file"
+)
+
 // Value represents an input value that should be gathered by Onboard. Values are made available to templates in order to render files.
 type Value struct {
 	// Name is the name of the input.
@@ -337,6 +453,54 @@ type Value struct {
 	Description string `json:"description"`
 	// Secret declares whether or not the input is sensitive.
 	Secret bool `json:"secret"`
+	// Type is the type of the input. It defaults to string.
+	Type ValueType `json:"type,omitempty"`
+	// Options are the allowed inputs of a select.
+	// This field is mutually exclusive with `OptionsFrom`.
+	Options []string `json:"options,omitempty"`
+	// OptionsFrom configures how the allowed inputs of a select are listed on the device when they are requested.
+	// This field is mutually exclusive with `Options`.
+	OptionsFrom *OptionsSource `json:"optionsFrom,omitempty"`
+	// MaxSize is the maximum size of an uploaded file in bytes.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// ContentTypes are the allowed media types of an uploaded file, e.g. text/plain or image/*.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// Required declares that the input cannot be empty. Inputs are required unless they opt out.
+	// The remaining constraints are only enforced on inputs that are not empty.
+	Required bool `json:"required"`
+	// Pattern is a regular expression that must match the entire input.
+	Pattern string `json:"pattern,omitempty"`
+	// MinLength is the minimum number of characters of the input.
+	MinLength int `json:"minLength,omitempty"`
+	// MaxLength is the maximum number of characters of the input.
+	MaxLength int `json:"maxLength,omitempty"`
+	// Enum is the list of allowed inputs.
+	Enum []string `json:"enum,omitempty"`
+	// Message is a human-friendly message shown instead of the default one when the input is invalid.
+	Message string `json:"message,omitempty"`
+	// Default is a Golang template for the input if none is given, which can refer to the facts about the device, e.g. onboard-{{ .Facts.ID }}.
+	// Clients prefill the input with it.
+	Default string `json:"default,omitempty"`
+	// Computed is a Golang template for a value that is not collected but derived from the facts about the device
+	// and the values declared before it, e.g. {{ .hostname }}.local. Computed values cannot be submitted.
+	Computed string `json:"computed,omitempty"`
+	// Current configures how the current value is read from the system, so that clients can prefill the input
+	// when the device is onboarded again. The current values of secret values are never published.
+	Current *CurrentValue `json:"current,omitempty"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+// Values that do not declare whether they are required are required,
+// since the webapp has never allowed empty inputs.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	// value has the fields but not the methods of Value, so that it is decoded as usual.
+	type value Value
+	x := value{Required: true}
+	if err := json.Unmarshal(data, &x); err != nil {
+		return err
+	}
+	*v = Value(x)
+	return nil
 }
 
 func (v *Value) validate() error {
@@ -347,16 +511,369 @@ func (v *Value) validate() error {
 	if !validName.MatchString(v.Name) {
 		errs = append(errs, fmt.Sprintf("value name %q does not match format %s", v.Name, validName.String()))
 	}
+	if v.Name == factsKey {
+		errs = append(errs, fmt.Sprintf("value name %q is reserved for the facts about the device", v.Name))
+	}
+	if v.Default != "" && v.Computed != "" {
+		errs = append(errs, fmt.Sprintf("value %q cannot have both a default and be computed", v.Name))
+	}
+	if v.Default != "" && v.Secret {
+		errs = append(errs, fmt.Sprintf("value %q is secret and cannot have a default, since defaults are published", v.Name))
+	}
+	if v.Current != nil {
+		if err := v.Current.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("value %q current: %v", v.Name, err))
+		}
+		if v.Computed != "" {
+			errs = append(errs, fmt.Sprintf("value %q is computed and cannot have a current value", v.Name))
+		}
+		if v.Type == ValueTypeFile {
+			errs = append(errs, fmt.Sprintf("value %q is a file and cannot have a current value", v.Name))
+		}
+	}
+	for name, text := range map[string]string{"default": v.Default, "computed": v.Computed} {
+		if _, err := template.New(name).Parse(text); err != nil {
+			errs = append(errs, fmt.Sprintf("value %q %s template is invalid: %v", v.Name, name, err))
+		}
+	}
+	switch v.Type {
+	case "":
+		v.Type = ValueTypeString
+	case ValueTypeString:
+	case ValueTypeBool:
+	case ValueTypeInt:
+	case ValueTypeSelect:
+	case ValueTypeMultiline:
+	case ValueTypeFile:
+	default:
+		errs = append(errs, fmt.Sprintf("value %q type must be one of: %s", v.Name, strings.Join([]string{string(ValueTypeString), string(ValueTypeBool), string(ValueTypeInt), string(ValueTypeSelect), string(ValueTypeMultiline), string(ValueTypeFile)}, ",")))
+	}
+	if v.Type == ValueTypeSelect && (len(v.Options) == 0) == (v.OptionsFrom == nil) {
+		errs = append(errs, fmt.Sprintf("value %q is a select and must have exactly one of 'options' or 'optionsFrom'", v.Name))
+	}
+	if v.Type != ValueTypeSelect && (len(v.Options) > 0 || v.OptionsFrom != nil) {
+		errs = append(errs, fmt.Sprintf("value %q has options but is not a select", v.Name))
+	}
+	if v.OptionsFrom != nil {
+		if err := v.OptionsFrom.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("value %q optionsFrom: %v", v.Name, err))
+		}
+	}
+	if v.Type != ValueTypeFile && (v.MaxSize != 0 || len(v.ContentTypes) > 0) {
+		errs = append(errs, fmt.Sprintf("value %q has a maximum size or content types but is not a file", v.Name))
+	}
+	if v.MaxSize < 0 {
+		errs = append(errs, fmt.Sprintf("value %q maximum size cannot be negative", v.Name))
+	}
+	for _, ct := range v.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			errs = append(errs, fmt.Sprintf("value %q content type %q is invalid: %v", v.Name, ct, err))
+		}
+	}
+	if _, err := v.pattern(); err != nil {
+		errs = append(errs, fmt.Sprintf("value %q pattern is invalid: %v", v.Name, err))
+	}
+	if v.MinLength < 0 || v.MaxLength < 0 {
+		errs = append(errs, fmt.Sprintf("value %q lengths cannot be negative", v.Name))
+	}
+	if v.MaxLength > 0 && v.MinLength > v.MaxLength {
+		errs = append(errs, fmt.Sprintf("value %q minLength cannot be greater than maxLength", v.Name))
+	}
 	if len(errs) > 0 {
 		return errors.New(strings.Join(errs, "; "))
 	}
 	return nil
 }
 
+// pattern compiles the value's pattern anchored to the entire input.
+// It returns nil if the value has no pattern.
+func (v *Value) pattern() (*regexp.Regexp, error) {
+	if v.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + v.Pattern + ")$")
+}
+
+// check validates the given input against the value's constraints.
+func (v *Value) check(s string) error {
+	if s == "" {
+		if v.Required {
+			return v.error("is required")
+		}
+		return nil
+	}
+	switch v.Type {
+	case ValueTypeBool:
+		if _, err := strconv.ParseBool(s); err != nil {
+			return v.error("must be true or false")
+		}
+	case ValueTypeInt:
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return v.error("must be an integer")
+		}
+	case ValueTypeSelect:
+		// Dynamic options are checked by validateValues, since listing them can fail.
+		if v.OptionsFrom != nil {
+			break
+		}
+		if !contains(v.Options, s) {
+			return v.error("must be one of " + quoteList(v.Options))
+		}
+	case ValueTypeFile:
+		if v.MaxSize > 0 && int64(len(s)) > v.MaxSize {
+			return v.error(fmt.Sprintf("must be at most %d bytes", v.MaxSize))
+		}
+	}
+	if n := utf8.RuneCountInString(s); n < v.MinLength {
+		return v.error(fmt.Sprintf("must be at least %d characters long", v.MinLength))
+	} else if v.MaxLength > 0 && n > v.MaxLength {
+		return v.error(fmt.Sprintf("must be at most %d characters long", v.MaxLength))
+	}
+	re, err := v.pattern()
+	if err != nil {
+		return fmt.Errorf("pattern is invalid: %w", err)
+	}
+	if re != nil && !re.MatchString(s) {
+		return v.error(fmt.Sprintf("must match pattern %q", v.Pattern))
+	}
+	if len(v.Enum) > 0 && !contains(v.Enum, s) {
+		return v.error("must be one of " + quoteList(v.Enum))
+	}
+	return nil
+}
+
+// native returns the input converted to the value's native type, i.e. a bool or an int64.
+// Empty inputs are converted to the zero value of the type.
+func (v *Value) native(s string) interface{} {
+	switch v.Type {
+	case ValueTypeBool:
+		b, _ := strconv.ParseBool(s)
+		return b
+	case ValueTypeInt:
+		i, _ := strconv.ParseInt(s, 10, 64)
+		return i
+	}
+	return s
+}
+
+// templateData returns the given values with their declared native types
+// and the current facts about the device under Facts for rendering templates.
+// Values that are not declared are left as strings.
+func (c *config) templateData(values map[string]string) map[string]interface{} {
+	return c.templateDataWithFacts(values, c.gatherFacts())
+}
+
+// templateDataWithFacts is like templateData but uses the given facts about the device.
+func (c *config) templateDataWithFacts(values map[string]string, facts *Facts) map[string]interface{} {
+	data := make(map[string]interface{}, len(values)+1)
+	for k, s := range values {
+		data[k] = s
+	}
+	for _, v := range c.Values {
+		if s, ok := values[v.Name]; ok {
+			data[v.Name] = v.native(s)
+		}
+	}
+	data[factsKey] = facts
+	return data
+}
+
+// gatherFacts gathers the facts about the device, which can change, e.g. the hostname.
+// It returns nil if the facts are not available, e.g. when the configuration is applied offline.
+func (c *config) gatherFacts() *Facts {
+	if c.facts == nil {
+		return nil
+	}
+	return c.facts()
+}
+
+// complete adds the default values of the values that were not given
+// and the computed values, in the order in which they are declared, to the given values.
+// Computed values only see the values declared before them, so undeclared values
+// and later defaults cannot leak into them. Computed values cannot be given.
+func (c *config) complete(values map[string]string) error {
+	var errs v1.ValueErrors
+	facts := c.gatherFacts()
+	declared := make(map[string]string, len(c.Values))
+	for _, v := range c.Values {
+		_, ok := values[v.Name]
+		switch {
+		case v.Computed != "" && ok:
+			errs = append(errs, &v1.ValueError{Name: v.Name, Err: errors.New("is computed and cannot be submitted")})
+		case v.Computed != "":
+			s, err := renderValueTemplate(v.Computed, c.templateDataWithFacts(declared, facts))
+			if err != nil {
+				errs = append(errs, &v1.ValueError{Name: v.Name, Err: fmt.Errorf("failed to compute value: %w", err)})
+				continue
+			}
+			values[v.Name] = s
+		case v.Default != "" && !ok:
+			s, err := renderDefault(v, facts)
+			if err != nil {
+				errs = append(errs, &v1.ValueError{Name: v.Name, Err: err})
+				continue
+			}
+			values[v.Name] = s
+		}
+		if s, ok := values[v.Name]; ok {
+			declared[v.Name] = s
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// defaults returns the rendered default values by name, e.g. for clients to prefill.
+// Defaults that cannot be rendered are omitted.
+func (c *config) defaults() map[string]string {
+	defaults := make(map[string]string)
+	facts := c.gatherFacts()
+	for _, v := range c.Values {
+		if v.Default == "" || v.Computed != "" {
+			continue
+		}
+		if s, err := renderDefault(v, facts); err == nil {
+			defaults[v.Name] = s
+		}
+	}
+	return defaults
+}
+
+// renderDefault renders the default of the given value, which can only refer to the given facts about the device.
+func renderDefault(v *Value, facts *Facts) (string, error) {
+	s, err := renderValueTemplate(v.Default, map[string]interface{}{factsKey: facts})
+	if err != nil {
+		return "", fmt.Errorf("failed to render default: %w", err)
+	}
+	return s, nil
+}
+
+// renderValueTemplate renders the given template of a value with the given template data.
+// Unlike other templates, a missing key is an error, since it is most likely a typo.
+func renderValueTemplate(text string, data map[string]interface{}) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		if data[factsKey] == (*Facts)(nil) && strings.Contains(err.Error(), factsKey) {
+			return "", fmt.Errorf("%w; facts about the device are not available offline", err)
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// quoteList returns the given strings quoted and separated by commas.
+func quoteList(list []string) string {
+	quoted := make([]string, 0, len(list))
+	for _, s := range list {
+		quoted = append(quoted, strconv.Quote(s))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// error returns the value's custom message, if any, or else the given message.
+func (v *Value) error(msg string) error {
+	if v.Message != "" {
+		return errors.New(v.Message)
+	}
+	return errors.New(msg)
+}
+
+// loadConfig reads, concatenates, and validates the configuration files matching the given paths.
+// Paths can be globs; files are processed in lexicographic order of their base names.
+func loadConfig(paths []string) (*config, error) {
+	var files []string
+	for _, path := range paths {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find matches for path %q: %w", path, err)
+		}
+		files = append(files, matches...)
+	}
+	cfg := &config{}
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %q: %w", file, err)
+		}
+		c := &config{}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("failed to read YAML from file %q: %w", file, err)
+		}
+		cfg.Actions = append(cfg.Actions, c.Actions...)
+		cfg.Checks = append(cfg.Checks, c.Checks...)
+		cfg.Values = append(cfg.Values, c.Values...)
+		if c.Register != nil {
+			if cfg.Register != nil {
+				return nil, fmt.Errorf("file %q configures registration, which was already configured", file)
+			}
+			cfg.Register = c.Register
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 type config struct {
 	Actions []*Action `json:"actions"`
 	Checks  []*Check  `json:"checks"`
 	Values  []*Value  `json:"values"`
+	// Register configures the registration of the device with a fleet backend
+	// after it has been onboarded and the checks have passed.
+	Register *Register `json:"register,omitempty"`
+	// facts gathers the facts about the device, which are available to templates.
+	// It is nil when the configuration is applied offline.
+	facts func() *Facts
+}
+
+// publicConfig is the configuration that is served to clients.
+type publicConfig struct {
+	*config
+	// EncryptionKey is the key with which clients must encrypt secret values.
+	EncryptionKey *encryptionKey `json:"encryptionKey,omitempty"`
+	// TLSFingerprint is the fingerprint of the HTTPS server's certificate, if HTTPS is enabled.
+	TLSFingerprint string `json:"tlsFingerprint,omitempty"`
+	// Pairing is whether clients must pair with a PIN before onboarding the device.
+	Pairing bool `json:"pairing,omitempty"`
+	// Defaults are the rendered default values by name, with which clients prefill inputs.
+	Defaults map[string]string `json:"defaults,omitempty"`
+}
+
+// Register configures the registration of the device with a fleet backend.
+type Register struct {
+	// URL is the URL to which the registration is POSTed.
+	URL string `json:"url"`
+}
+
+func (r *Register) validate() error {
+	if len(r.URL) == 0 {
+		return errors.New("register URL cannot be empty")
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("register URL %q is invalid: %v", r.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("register URL %q must use http or https", r.URL)
+	}
+	return nil
 }
 
 func (c *config) validate() error {
@@ -403,8 +920,60 @@ func (c *config) validate() error {
 			values[v.Name] = struct{}{}
 		}
 	}
+	if c.Register != nil {
+		if err := c.Register.validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
 	if len(errs) > 0 {
 		return fmt.Errorf("configuration contains validation errors: %s", strings.Join(errs, "; "))
 	}
 	return nil
 }
+
+// validateValues validates that the given values match the values declared in the configuration
+// and satisfy their constraints.
+func (c *config) validateValues(values map[string]string) error {
+	var errs v1.ValueErrors
+	declared := make(map[string]struct{}, len(c.Values))
+	for _, v := range c.Values {
+		declared[v.Name] = struct{}{}
+		s, ok := values[v.Name]
+		if !ok {
+			// Values with defaults and computed values are added by the device.
+			if v.Default == "" && v.Computed == "" {
+				errs = append(errs, &v1.ValueError{Name: v.Name, Err: errors.New("is missing")})
+			}
+			continue
+		}
+		if err := v.check(s); err != nil {
+			errs = append(errs, &v1.ValueError{Name: v.Name, Err: err})
+			continue
+		}
+		// Dynamic options can only be listed on the device.
+		if s != "" && v.Type == ValueTypeSelect && v.OptionsFrom != nil && v.OptionsFrom.cache != nil {
+			options, err := v.OptionsFrom.list(context.Background())
+			if err != nil {
+				// The submitted value is not at fault, so this is not a ValueError.
+				return fmt.Errorf("failed to list options of value %q: %w", v.Name, err)
+			}
+			if !contains(options, s) {
+				errs = append(errs, &v1.ValueError{Name: v.Name, Err: v.error("must be one of the listed options")})
+			}
+		}
+	}
+	var unknown []string
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, &v1.ValueError{Name: name, Err: errors.New("is not declared in the configuration")})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	flag "github.com/spf13/pflag"
+)
+
+// device is an Onboard device that was discovered via mDNS.
+type device struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Host      string   `json:"host"`
+	Addresses []string `json:"addresses"`
+	Port      int      `json:"port"`
+	State     string   `json:"state,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	// TLSPort and TLSFingerprint are set if the device serves HTTPS.
+	TLSPort        int    `json:"tlsPort,omitempty"`
+	TLSFingerprint string `json:"tlsFingerprint,omitempty"`
+}
+
+// deviceFromEntry converts an mDNS service entry into a device.
+// If the entry was not advertised by Onboard, then nil is returned.
+func deviceFromEntry(e *mdns.ServiceEntry) *device {
+	fields := make(map[string]string)
+	for _, f := range e.InfoFields {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields[parts[0]] = parts[1]
+	}
+	id, ok := fields["id"]
+	if !ok {
+		return nil
+	}
+	d := &device{
+		ID:      id,
+		Name:    e.Name,
+		Host:    strings.TrimSuffix(e.Host, "."),
+		Port:    e.Port,
+		State:   fields["state"],
+		Version: fields["version"],
+	}
+	if port, err := strconv.Atoi(fields["tls-port"]); err == nil {
+		d.TLSPort = port
+		d.TLSFingerprint = fields["tls-fingerprint"]
+	}
+	for _, ip := range []net.IP{e.AddrV4, e.AddrV6} {
+		if ip != nil {
+			d.Addresses = append(d.Addresses, ip.String())
+		}
+	}
+	return d
+}
+
+func discover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "The amount of time to wait for devices to respond.")
+	output := fs.StringP("output", "o", "table", "The output format. Options: 'table', 'json'.")
+	service := fs.String("service", strings.TrimSuffix(mdnsService, "."), "The mDNS service to browse.")
+	iface := fs.String("interface", "", "The name of the interface on which to browse. Defaults to the system's default multicast interface.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unexpected output format: %s", *output)
+	}
+
+	params := mdns.DefaultParams(*service)
+	params.Timeout = *timeout
+	// The mDNS client logs failures to bind to individual address families,
+	// which are expected on hosts without IPv6, so silence it.
+	params.Logger = stdlog.New(ioutil.Discard, "", 0)
+	if *iface != "" {
+		i, err := net.InterfaceByName(*iface)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %q: %w", *iface, err)
+		}
+		params.Interface = i
+	}
+	entries := make(chan *mdns.ServiceEntry)
+	params.Entries = entries
+	devices := make(map[string]*device)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range entries {
+			if d := deviceFromEntry(e); d != nil {
+				devices[d.Name] = d
+			}
+		}
+	}()
+	err := mdns.Query(params)
+	close(entries)
+	<-done
+	if err != nil {
+		return fmt.Errorf("failed to browse mDNS: %w", err)
+	}
+
+	ds := make([]*device, 0, len(devices))
+	for _, d := range devices {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID < ds[j].ID })
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ds)
+	}
+	return printDevices(os.Stdout, ds)
+}
+
+func printDevices(w io.Writer, ds []*device) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOST\tADDRESSES\tPORT\tSTATE\tVERSION")
+	for _, d := range ds {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", d.ID, d.Host, strings.Join(d.Addresses, ","), d.Port, d.State, d.Version)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// encryptionKeyBits is the size of the ephemeral key with which clients encrypt secret values.
+const encryptionKeyBits = 2048
+
+// encryptionKey is an RSA public key in JSON Web Key format,
+// which can be used directly by the webapp.
+type encryptionKey struct {
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+func newEncryptionKey(pub *rsa.PublicKey) *encryptionKey {
+	return &encryptionKey{
+		KeyType:   "RSA",
+		Algorithm: "RSA-OAEP-256",
+		N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func (k *encryptionKey) publicKey() (*rsa.PublicKey, error) {
+	if k.KeyType != "RSA" {
+		return nil, fmt.Errorf("unexpected key type %q", k.KeyType)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode exponent: %w", err)
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent is too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// encryptValue encrypts the value with RSA-OAEP using SHA-256.
+// The value is split into chunks that fit into a single RSA-OAEP message,
+// which are encrypted individually, base64-encoded, and joined with periods.
+// Empty values are encrypted as a single empty chunk.
+func encryptValue(pub *rsa.PublicKey, value string) (string, error) {
+	size := pub.Size() - 2*sha256.Size - 2
+	data := []byte(value)
+	var chunks []string
+	for {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data[:n], nil)
+		if err != nil {
+			return "", err
+		}
+		chunks = append(chunks, base64.StdEncoding.EncodeToString(ciphertext))
+		if data = data[n:]; len(data) == 0 {
+			break
+		}
+	}
+	return strings.Join(chunks, "."), nil
+}
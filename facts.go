@@ -0,0 +1,99 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// serialNumberPath contains the serial number of the board on devices with a device tree.
+	serialNumberPath = "/proc/device-tree/serial-number"
+	// cpuInfoPath contains the serial number of the board on some devices without one in the device tree.
+	cpuInfoPath = "/proc/cpuinfo"
+	// machineIDPath contains the systemd machine ID.
+	machineIDPath = "/etc/machine-id"
+)
+
+// Facts are facts about the device. They are available to templates under .Facts.
+// Facts that cannot be determined are empty.
+type Facts struct {
+	// ID is the ID of the device.
+	ID string
+	// MACAddresses are the hardware addresses of the device's network interfaces by interface name.
+	MACAddresses map[string]string
+	// Model is the model of the board.
+	Model string
+	// Serial is the serial number of the board.
+	Serial string
+	// MachineID is the systemd machine ID.
+	MachineID string
+	// Hostname is the current hostname.
+	Hostname string
+}
+
+// gatherFacts gathers the facts about the device with the given ID.
+func gatherFacts(id string) *Facts {
+	f := &Facts{
+		ID:           id,
+		MACAddresses: make(map[string]string),
+		Model:        boardModel(),
+		Serial:       serialNumber(),
+		MachineID:    readFact(machineIDPath),
+	}
+	f.Hostname, _ = os.Hostname()
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+				continue
+			}
+			f.MACAddresses[iface.Name] = iface.HardwareAddr.String()
+		}
+	}
+	return f
+}
+
+// serialNumber returns the serial number of the board, or an empty string if it is unknown.
+func serialNumber() string {
+	if s := readFact(serialNumberPath); s != "" {
+		return s
+	}
+	file, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Serial" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// readFact returns the trimmed contents of the given file, or an empty string if it cannot be read.
+func readFact(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+}
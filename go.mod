@@ -6,8 +6,9 @@ require (
 	github.com/campoy/embedmd v1.0.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/go-kit/kit v0.10.0
-	github.com/hashicorp/mdns v1.0.1
+	github.com/hashicorp/mdns v1.0.6
 	github.com/metalmatze/signal v0.0.0-20201002155117-1bb3cf83a279
+	github.com/miekg/dns v1.1.55
 	github.com/oklog/run v1.1.0
 	github.com/prometheus/client_golang v1.8.0
 	github.com/spf13/pflag v1.0.5
@@ -0,0 +1,141 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// headlessStatusFile is the name of the file, next to the values file,
+	// in which the result of headless onboarding is recorded.
+	headlessStatusFile = "onboard-status.json"
+	headlessCheckTries = 10
+	headlessInterval   = 5 * time.Second
+)
+
+// handlerTransport is an http.RoundTripper that serves requests in-process with a handler.
+// It allows the API to be driven exactly as the webapp drives it, without going over the network.
+// Requests appear to come from the loopback interface, since they originate on the device itself.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	b := &responseBuffer{header: make(http.Header)}
+	r = r.Clone(r.Context())
+	r.RemoteAddr = "127.0.0.1:0"
+	t.h.ServeHTTP(b, r)
+	// Handlers that write nothing respond with 200 OK.
+	b.WriteHeader(http.StatusOK)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", b.status, http.StatusText(b.status)),
+		StatusCode:    b.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        b.header,
+		Body:          ioutil.NopCloser(&b.body),
+		ContentLength: int64(b.body.Len()),
+		Request:       r,
+	}, nil
+}
+
+// responseBuffer is an http.ResponseWriter that buffers the response of a handler in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader records the status code. Only the first call has an effect, as with a real connection.
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+type headlessStatus struct {
+	Timestamp time.Time `json:"timestamp"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+	// Report lists the result of every check that was run.
+	Report string `json:"report"`
+}
+
+// onboardHeadless onboards the device with the values from the file at the given path, if it exists,
+// and reports whether the file existed.
+// The values are submitted to the API and the checks are run exactly as if the webapp had done so.
+// The values file is removed once it has been read so that secrets do not linger,
+// and the result is recorded in a status file in the same directory.
+func onboardHeadless(l log.Logger, path string, cfg *config, h http.Handler) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat values file %q: %w", path, err)
+	}
+	level.Info(l).Log("msg", "onboarding from values file", "path", path)
+	values, err := readValues(path)
+	if rerr := os.Remove(path); rerr != nil {
+		level.Error(l).Log("msg", "failed to remove values file", "path", path, "error", rerr.Error())
+	}
+
+	var report bytes.Buffer
+	if err == nil {
+		c := &client{endpoint: "http://onboard", c: &http.Client{Transport: handlerTransport{h}}}
+		err = submitValues(&report, c, cfg, values, headlessCheckTries, headlessInterval)
+	}
+
+	status := headlessStatus{
+		Timestamp: time.Now(),
+		Succeeded: err == nil,
+		Report:    report.String(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+		level.Error(l).Log("msg", "failed to onboard from values file", "error", err.Error())
+	} else {
+		level.Info(l).Log("msg", "onboarded from values file")
+	}
+	buf, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return true, fmt.Errorf("failed to marshal status: %w", err)
+	}
+	statusPath := filepath.Join(filepath.Dir(path), headlessStatusFile)
+	if err := ioutil.WriteFile(statusPath, buf, 0644); err != nil {
+		return true, fmt.Errorf("failed to write status file %q: %w", statusPath, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// signatureHeader carries the base64-encoded Ed25519 signature of a request body
+	// made with the device's identity.
+	signatureHeader = "X-Onboard-Signature"
+	// publicKeyHeader carries the base64-encoded Ed25519 public key of the device's identity.
+	publicKeyHeader = "X-Onboard-Public-Key"
+)
+
+// identity is the stable cryptographic identity of the device.
+// It is generated on first boot and never leaves the device.
+type identity struct {
+	key ed25519.PrivateKey
+}
+
+// loadIdentity loads the identity from the key at the given path,
+// generating and saving a new key if none exists.
+func loadIdentity(path string) (*identity, error) {
+	key, err := loadOrCreateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{key: key}, nil
+}
+
+func (i *identity) publicKey() ed25519.PublicKey {
+	return i.key.Public().(ed25519.PublicKey)
+}
+
+// sign returns the base64-encoded signature of the given data.
+func (i *identity) sign(data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(i.key, data))
+}
+
+// loadOrCreateKey loads the Ed25519 private key at the given path,
+// generating and saving a new key if none exists.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode PEM in key file %q", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file %q: %w", path, err)
+		}
+		key, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key file %q does not contain an Ed25519 key", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read key file %q: %w", path, err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := writeKey(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKey writes the given private key to the given path in PKCS #8 PEM format,
+// creating any missing parent directories.
+func writeKey(path string, key interface{}) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for key file %q: %w", path, err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return fmt.Errorf("failed to write key file %q: %w", path, err)
+	}
+	return nil
+}
@@ -16,6 +16,9 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"fmt"
@@ -26,14 +29,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"sort"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/ghodss/yaml"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/mdns"
@@ -44,6 +43,7 @@ import (
 	flag "github.com/spf13/pflag"
 
 	v1 "github.com/squat/onboard/api/v1"
+	"github.com/squat/onboard/version"
 )
 
 type options struct {
@@ -51,11 +51,18 @@ type options struct {
 	logFormat string
 	name      string
 
-	id            string
-	ipAddress     string
-	wlanInterface string
-	paths         []string
-	cfg           *config
+	id             string
+	ipAddress      string
+	mdnsInterfaces []string
+	wlanInterface  string
+	headlessValues string
+	provisioning   provisioningConfig
+	identityKey    string
+	pairing        pairingConfig
+	reonboardFile  string
+	deferredDelay  time.Duration
+	paths          []string
+	cfg            *config
 
 	server serverConfig
 }
@@ -64,6 +71,14 @@ type serverConfig struct {
 	listen         string
 	listenInternal string
 	healthcheckURL string
+	tls            tlsConfig
+}
+
+type tlsConfig struct {
+	listen   string
+	cert     string
+	key      string
+	redirect bool
 }
 
 //go:embed static/build
@@ -76,10 +91,34 @@ func parseFlags() (*options, error) {
 	flag.StringVar(&opts.logFormat, "log.format", "logfmt", "The log format to use. Options: 'logfmt', 'json'.")
 	flag.StringVar(&opts.server.listen, "web.listen", ":8080", "The address on which the public server listens.")
 	flag.StringVar(&opts.server.listenInternal, "web.internal.listen", ":8081", "The address on which the internal server listens.")
+	flag.StringVar(&opts.server.tls.listen, "web.tls.listen", "", "The address on which the public HTTPS server listens. If empty, HTTPS is disabled.")
+	flag.StringVar(&opts.server.tls.cert, "web.tls.cert", "/var/lib/onboard/tls.crt", "The path to the certificate for the HTTPS server. If neither the certificate nor the key exists, a self-signed certificate is generated and persisted.")
+	flag.StringVar(&opts.server.tls.key, "web.tls.key", "/var/lib/onboard/tls.key", "The path to the key for the HTTPS server's certificate.")
+	flag.BoolVar(&opts.server.tls.redirect, "web.tls.redirect", false, "Redirect requests to the public HTTP server to the HTTPS server.")
 	flag.StringVar(&opts.server.healthcheckURL, "web.healthchecks.url", "http://localhost:8080", "The URL against which to run healthchecks.")
 	flag.StringVar(&opts.id, "id", "", "The ID for this device.")
-	flag.StringVar(&opts.ipAddress, "ip-address", "10.0.0.1", "The IP address of the device running this process.")
+	flag.StringVar(&opts.ipAddress, "ip-address", "10.0.0.1", "The IP address of the device running this process. It is advertised via mDNS when none of the mDNS interfaces have an address.")
+	flag.StringArrayVar(&opts.mdnsInterfaces, "mdns.interface", []string{"ap0", "wlan0"}, "The name of an interface whose addresses should be advertised via mDNS. Can be specified multiple times.")
 	flag.StringVar(&opts.wlanInterface, "wlan-interface", "wlan0", "The name of the WLAN interface to configure.")
+	flag.StringVar(&opts.headlessValues, "headless.values", "/boot/onboard-values.yaml", "The path to a YAML or JSON file of values with which to onboard the device on startup without the webapp. The file is removed once it has been read and the result is recorded in onboard-status.json next to it. Set to an empty string to disable.")
+	flag.StringVar(&opts.provisioning.url, "provisioning.url", "", "The URL of a provisioning server from which to fetch values on startup. Values are fetched from <url>/devices/<id>. If the device is unknown to the server or the server is unreachable, the device falls back to the wizard.")
+	flag.StringVar(&opts.provisioning.tokenFile, "provisioning.token-file", "", "The path to a file containing a bearer token with which to authenticate to the provisioning server.")
+	flag.StringVar(&opts.provisioning.certFile, "provisioning.tls.cert", "", "The path to a client certificate with which to authenticate to the provisioning server.")
+	flag.StringVar(&opts.provisioning.keyFile, "provisioning.tls.key", "", "The path to the key for the client certificate.")
+	flag.StringVar(&opts.provisioning.caFile, "provisioning.tls.ca", "", "The path to a CA bundle with which to verify the provisioning server. Defaults to the system's CAs.")
+	flag.DurationVar(&opts.provisioning.timeout, "provisioning.timeout", 2*time.Minute, "How long to keep trying to reach the provisioning server before falling back to the wizard.")
+	flag.StringVar(&opts.identityKey, "identity.key", "/var/lib/onboard/device.key", "The path to the Ed25519 key that identifies this device. A key is generated on first boot if none exists. It is used to sign registrations and certificate signing requests.")
+	// The identity key used to be only the key with which registrations are signed.
+	// Devices that set its path must keep their key, so that backends recognize them.
+	flag.StringVar(&opts.identityKey, "register.key", "/var/lib/onboard/device.key", "The path to the Ed25519 key with which registrations are signed.")
+	if err := flag.CommandLine.MarkDeprecated("register.key", "use --identity.key instead"); err != nil {
+		return nil, err
+	}
+	flag.StringVar(&opts.pairing.secretFile, "pairing.secret-file", "", "The path to a secret from which the pairing PIN is derived. If set, clients must pair with the PIN before they can use mutating and log endpoints. A secret is generated if none exists. If empty, pairing is disabled.")
+	flag.StringVar(&opts.pairing.pinFile, "pairing.pin-file", "", "The path to a file to which the pairing PIN is written, e.g. on the boot partition, for devices without a printed label.")
+	flag.DurationVar(&opts.pairing.sessionTTL, "pairing.session-ttl", time.Hour, "How long a session obtained by pairing remains valid.")
+	flag.StringVar(&opts.reonboardFile, "reonboard.file", "/run/onboard/reonboard", "The path to a file whose existence allows an onboarded device to be onboarded again, e.g. created by a physical button. The file is removed when re-onboarding starts. Requests from the device itself and paired clients may always re-onboard the device.")
+	flag.DurationVar(&opts.deferredDelay, "actions.deferred-delay", 5*time.Second, "How long to wait after onboarding has finished before running deferred actions, e.g. reboots, so that clients can receive the result first.")
 	flag.StringArrayVarP(&opts.paths, "config", "c", nil, "The path to the configuration file for Onboard. Can be specified multiple times to concatenate mutiple configuration files. Can be a glob, e.g. /path/to/configs/*.yaml. Files are processed in lexicographic order.")
 
 	flag.Parse()
@@ -97,37 +136,36 @@ func parseFlags() (*options, error) {
 		return nil, fmt.Errorf("unexpected log level: %s", *logLevelRaw)
 	}
 
-	var paths []string
-	for _, path := range opts.paths {
-		matches, err := filepath.Glob(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find matches for path %q: %w", path, err)
-		}
-		paths = append(paths, matches...)
-	}
-	opts.cfg = &config{}
-	sort.Slice(paths, func(i, j int) bool { return filepath.Base(paths[i]) < filepath.Base(paths[j]) })
-	for _, path := range paths {
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read file %q: %w", path, err)
-		}
-		c := &config{}
-		if err := yaml.Unmarshal(data, c); err != nil {
-			return nil, fmt.Errorf("failed to read YAML from file %q: %w", path, err)
-		}
-		opts.cfg.Actions = append(opts.cfg.Actions, c.Actions...)
-		opts.cfg.Checks = append(opts.cfg.Checks, c.Checks...)
-		opts.cfg.Values = append(opts.cfg.Values, c.Values...)
-	}
-	if err := opts.cfg.validate(); err != nil {
+	var err error
+	if opts.cfg, err = loadConfig(opts.paths); err != nil {
 		return nil, err
 	}
+	// Facts are gathered whenever they are used, since some of them, e.g. the hostname, change during onboarding.
+	opts.cfg.facts = func() *Facts {
+		return gatherFacts(opts.id)
+	}
+	opts.cfg.initOptions()
 
 	return opts, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "apply":
+			cmd = apply
+		case "discover":
+			cmd = discover
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				stdlog.Fatal(err)
+			}
+			return
+		}
+	}
+
 	opts, err := parseFlags()
 	if err != nil {
 		stdlog.Fatal(err)
@@ -166,6 +204,96 @@ func main() {
 		)
 	}
 
+	wifiEvents := v1.NewWiFiEvents(reg, logger, opts.wlanInterface)
+
+	ident, err := loadIdentity(opts.identityKey)
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+
+	var tlsCert *tls.Certificate
+	var tlsPort int
+	var fingerprint string
+	if opts.server.tls.listen != "" {
+		if tlsPort, err = listenPort(opts.server.tls.listen); err != nil {
+			stdlog.Fatal(err)
+		}
+		cert, err := loadOrCreateCertificate(opts.server.tls.cert, opts.server.tls.key, []string{strings.TrimSuffix(mdnsHost(opts.id), "."), strings.TrimSuffix(mdnsAlias, ".")}, []net.IP{net.ParseIP(opts.ipAddress)})
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		tlsCert = &cert
+		fingerprint = certificateFingerprint(cert)
+		level.Info(logger).Log("msg", "loaded TLS certificate", "fingerprint", fingerprint)
+	}
+
+	var pairing *v1.Pairing
+	if opts.pairing.secretFile != "" {
+		secret, err := loadOrCreatePairingSecret(opts.pairing.secretFile)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		pin := pairingPIN(secret)
+		if opts.pairing.pinFile != "" {
+			if err := writeFile(opts.pairing.pinFile, []byte(pin+"\n"), 0600); err != nil {
+				stdlog.Fatal(err)
+			}
+		}
+		pairing = v1.NewPairing(reg, logger, pin, opts.pairing.sessionTTL)
+	}
+
+	var r *registrar
+	// apiRegistrar must remain a nil interface if registration is not configured.
+	var apiRegistrar v1.Registrar
+	if opts.cfg.Register != nil {
+		if r, err = newRegistrar(logger, opts.id, opts.cfg, ident); err != nil {
+			stdlog.Fatal(err)
+		}
+		apiRegistrar = r
+	}
+
+	actions := make([]v1.Action, 0, len(opts.cfg.Actions))
+	for _, a := range opts.cfg.Actions {
+		actions = append(actions, v1.Action{Name: a.Name, Run: a.action(ident), Deferred: a.deferred()})
+	}
+	var secrets []string
+	files := make(map[string]v1.File)
+	for _, v := range opts.cfg.Values {
+		if v.Secret {
+			secrets = append(secrets, v.Name)
+			continue
+		}
+		// Secret files must be encrypted, so they cannot be uploaded as files.
+		if v.Type == ValueTypeFile {
+			files[v.Name] = v1.File{MaxSize: v.MaxSize, ContentTypes: v.ContentTypes}
+		}
+	}
+	// The key is regenerated on every start so that secrets
+	// captured over the open access point cannot be decrypted later.
+	key, err := rsa.GenerateKey(rand.Reader, encryptionKeyBits)
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+	onboarding, err := v1.NewOnboarding(logger, v1.OnboardingOptions{
+		Actions:       actions,
+		Secrets:       secrets,
+		Files:         files,
+		Complete:      opts.cfg.complete,
+		CurrentValues: opts.cfg.currentValues,
+		ListOptions:   opts.cfg.options,
+		Validate:      opts.cfg.validateValues,
+		Key:           key,
+		Registrar:     apiRegistrar,
+		Pairing:       pairing,
+		StatePath:     onboardingStatePath,
+		InitialState:  legacyOnboardingState(),
+		DeferredDelay: opts.deferredDelay,
+		ReonboardFile: opts.reonboardFile,
+	})
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+
 	level.Info(logger).Log("msg", "starting onboard")
 	var g run.Group
 	{
@@ -185,16 +313,13 @@ func main() {
 			"/":       {},
 			"/submit": {},
 		}
-		j := []byte("{}")
-		var err error
-		actions := make([]func(map[string]string) error, 0, len(opts.cfg.Actions))
-		for _, a := range opts.cfg.Actions {
-			actions = append(actions, a.action())
+		if pairing != nil {
+			knownPaths["/pair"] = struct{}{}
 		}
 		for _, v := range opts.cfg.Values {
 			knownPaths["/"+v.Name] = struct{}{}
 		}
-		j, err = json.Marshal(opts.cfg)
+		j, err := json.Marshal(publicConfig{config: opts.cfg, EncryptionKey: newEncryptionKey(&key.PublicKey), TLSFingerprint: fingerprint, Pairing: pairing != nil, Defaults: opts.cfg.defaults()})
 		if err != nil {
 			stdlog.Fatal(err)
 		}
@@ -203,10 +328,42 @@ func main() {
 			stdlog.Fatal(err)
 		}
 		staticHandler := http.FileServer(http.FS(staticFS))
-		v1Handler := v1.New(reg, logger, opts.id, opts.wlanInterface, actions)
+		v1Handler := v1.New(reg, logger, opts.wlanInterface, j, onboarding, wifiEvents, ident.publicKey())
+		if r != nil {
+			r.h = v1Handler
+		}
+		// In-process clients use the API directly, so only the public servers require pairing.
+		apiHandler := v1Handler
+		if pairing != nil {
+			apiHandler = pairing.Protect(v1Handler)
+		}
+		var p *provisioner
+		if opts.provisioning.url != "" {
+			if p, err = newProvisioner(opts.provisioning); err != nil {
+				stdlog.Fatal(err)
+			}
+		}
+		go func() {
+			if opts.headlessValues != "" {
+				applied, err := onboardHeadless(logger, opts.headlessValues, opts.cfg, v1Handler)
+				if err != nil {
+					level.Error(logger).Log("msg", "failed to onboard headlessly", "error", err.Error())
+				}
+				if applied {
+					return
+				}
+			}
+			if p != nil && onboarding.State() != v1.OnboardingStateOnboarded {
+				ctx, cancel := context.WithTimeout(context.Background(), opts.provisioning.timeout)
+				defer cancel()
+				if err := provision(ctx, logger, p, opts.id, opts.cfg, v1Handler); err != nil {
+					level.Error(logger).Log("msg", "failed to provision device", "error", err.Error())
+				}
+			}
+		}()
 		h := func(w http.ResponseWriter, r *http.Request) {
 			if strings.HasPrefix(r.URL.Path, "/api/") {
-				v1Handler.ServeHTTP(w, r)
+				apiHandler.ServeHTTP(w, r)
 				return
 			}
 			if _, ok := knownPaths[r.URL.Path]; ok {
@@ -223,9 +380,18 @@ func main() {
 				staticHandler.ServeHTTP(w, r)
 			}
 		}
+		var handler http.Handler = http.HandlerFunc(h)
+		if tlsCert != nil && opts.server.tls.redirect {
+			handler = redirectToHTTPS(tlsPort, handler)
+		}
+		// Requests are bound to ctx, which is cancelled on shutdown,
+		// so that event streams do not hold the servers open.
+		ctx, cancel := context.WithCancel(context.Background())
+		baseContext := func(net.Listener) context.Context { return ctx }
 		s := http.Server{
-			Addr:    opts.server.listen,
-			Handler: http.HandlerFunc(h),
+			Addr:        opts.server.listen,
+			Handler:     handler,
+			BaseContext: baseContext,
 		}
 
 		g.Add(func() error {
@@ -233,8 +399,53 @@ func main() {
 			return s.ListenAndServe()
 		}, func(err error) {
 			level.Info(logger).Log("msg", "shutting down the HTTP server")
+			cancel()
 			_ = s.Shutdown(context.Background())
 		})
+
+		if tlsCert != nil {
+			ts := http.Server{
+				Addr:        opts.server.tls.listen,
+				Handler:     http.HandlerFunc(h),
+				TLSConfig:   &tls.Config{Certificates: []tls.Certificate{*tlsCert}},
+				BaseContext: baseContext,
+			}
+
+			g.Add(func() error {
+				level.Info(logger).Log("msg", "starting the HTTPS server", "address", opts.server.tls.listen)
+				return ts.ListenAndServeTLS("", "")
+			}, func(err error) {
+				level.Info(logger).Log("msg", "shutting down the HTTPS server")
+				cancel()
+				_ = ts.Shutdown(context.Background())
+			})
+		}
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting to follow Wi-Fi events")
+			return wifiEvents.Run(ctx)
+		}, func(err error) {
+			cancel()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return onboarding.Run(ctx)
+		}, func(err error) {
+			cancel()
+		})
+	}
+	if r != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting registrar", "url", opts.cfg.Register.URL)
+			return r.Run(ctx)
+		}, func(err error) {
+			cancel()
+		})
 	}
 	{
 		h := internalserver.NewHandler(
@@ -257,29 +468,39 @@ func main() {
 		})
 	}
 	{
-		parts := strings.Split(opts.server.listen, ":")
-		if len(parts) == 0 {
-			stdlog.Fatal("invalid listening address")
-		}
-		port, err := strconv.Atoi(parts[len(parts)-1])
+		port, err := listenPort(opts.server.listen)
 		if err != nil {
 			stdlog.Fatal(err)
 		}
-		service, err := mdns.NewMDNSService(strings.TrimSpace(fmt.Sprintf("Onboard %s", opts.id)), "_http._tcp.", "local.", "onboard.local.", port, []net.IP{net.ParseIP(opts.ipAddress)}, []string{fmt.Sprintf("id=%s", opts.id)})
+		z, err := newZone(logger, strings.TrimSpace(fmt.Sprintf("Onboard %s", opts.id)), mdnsHost(opts.id), port, net.ParseIP(opts.ipAddress), func() []string {
+			txt := []string{
+				fmt.Sprintf("id=%s", opts.id),
+				fmt.Sprintf("state=%s", onboarding.State()),
+				fmt.Sprintf("version=%s", version.Version),
+				fmt.Sprintf("port=%d", port),
+			}
+			if tlsCert != nil {
+				txt = append(txt, fmt.Sprintf("tls-port=%d", tlsPort), fmt.Sprintf("tls-fingerprint=%s", fingerprint))
+			}
+			return txt
+		})
 		if err != nil {
 			stdlog.Fatal(err)
 		}
-		server, err := mdns.NewServer(&mdns.Config{Zone: service})
+		server, err := mdns.NewServer(&mdns.Config{Zone: z})
 		if err != nil {
 			stdlog.Fatal(err)
 		}
-		stop := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting mDNS server")
-			<-stop
+			if err := z.watch(ctx, opts.mdnsInterfaces); err != nil {
+				server.Shutdown()
+				return err
+			}
 			return server.Shutdown()
 		}, func(err error) {
-			close(stop)
+			cancel()
 		})
 	}
 
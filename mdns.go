@@ -0,0 +1,213 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	mdnsService = "_http._tcp."
+	mdnsDomain  = "local."
+	// mdnsAlias is the well-known name at which every device can be reached on its own access point.
+	// It is not used as the host of the service, since clients match addresses to services by host,
+	// and so it would mix up the addresses of several devices on the same network.
+	mdnsAlias = "onboard.local."
+)
+
+// mdnsHost returns the host that the device with the given ID advertises, e.g. onboard-abc.local.
+// Characters that are not allowed in host names are replaced with hyphens.
+// Devices without an ID advertise the alias.
+func mdnsHost(id string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, id)
+	if label = strings.Trim(label, "-"); label == "" {
+		return mdnsAlias
+	}
+	return "onboard-" + label + "." + mdnsDomain
+}
+
+// zone is an mDNS zone that advertises the current addresses of a set of interfaces.
+// It implements the mdns.Zone interface.
+type zone struct {
+	instance string
+	host     string
+	port     int
+	// fallback is advertised when none of the interfaces have an address.
+	fallback net.IP
+	// txt returns the TXT records to advertise.
+	// It is called for every query so that the records reflect the current state.
+	txt func() []string
+	l   log.Logger
+
+	mu      sync.Mutex
+	ips     []net.IP
+	records []string
+	service *mdns.MDNSService
+}
+
+func newZone(l log.Logger, instance, host string, port int, fallback net.IP, txt func() []string) (*zone, error) {
+	z := &zone{
+		instance: instance,
+		host:     host,
+		port:     port,
+		fallback: fallback,
+		txt:      txt,
+		l:        l,
+	}
+	if err := z.update(nil, txt()); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// update rebuilds the service for the given addresses and TXT records.
+// The caller must hold the lock or have exclusive access to the zone.
+func (z *zone) update(ips []net.IP, records []string) error {
+	advertised := ips
+	if len(advertised) == 0 {
+		advertised = []net.IP{z.fallback}
+	}
+	s, err := mdns.NewMDNSService(z.instance, mdnsService, mdnsDomain, z.host, z.port, advertised, records)
+	if err != nil {
+		return fmt.Errorf("failed to create mDNS service: %w", err)
+	}
+	z.ips = ips
+	z.records = records
+	z.service = s
+	return nil
+}
+
+// Records implements the mdns.Zone interface.
+func (z *zone) Records(q dns.Question) []dns.RR {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if records := z.txt(); !equalStrings(records, z.records) {
+		if err := z.update(z.ips, records); err != nil {
+			level.Warn(z.l).Log("msg", "failed to update mDNS TXT records", "error", err.Error())
+		}
+	}
+	if q.Name == mdnsAlias && q.Name != z.host {
+		// Only the addresses are answered for the alias, so that it never appears in the records of the service.
+		q.Name = z.host
+		rrs := z.service.Records(q)
+		for _, rr := range rrs {
+			rr.Header().Name = mdnsAlias
+		}
+		return rrs
+	}
+	return z.service.Records(q)
+}
+
+func (z *zone) setIPs(ips []net.IP) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.update(ips, z.records); err != nil {
+		level.Warn(z.l).Log("msg", "failed to update mDNS addresses", "error", err.Error())
+		return
+	}
+	level.Debug(z.l).Log("msg", "updated mDNS addresses", "addresses", fmt.Sprintf("%v", ips))
+}
+
+// watch keeps the advertised addresses in sync with the addresses of the given interfaces.
+// It blocks until the context is cancelled.
+func (z *zone) watch(ctx context.Context, ifaces []string) error {
+	ch := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		// Drain the channel so that the subscription goroutine can exit.
+		// It is blocked receiving from a netlink socket without a timeout and only notices
+		// that done is closed once another update arrives, so the drain must not block the return.
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	if err := netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			level.Warn(z.l).Log("msg", "address subscription failed", "error", err.Error())
+		},
+	}); err != nil {
+		close(ch)
+		return fmt.Errorf("failed to subscribe to address updates: %w", err)
+	}
+	z.setIPs(interfaceIPs(z.l, ifaces))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("address subscription closed")
+			}
+			z.setIPs(interfaceIPs(z.l, ifaces))
+		}
+	}
+}
+
+// interfaceIPs returns all routable IPv4 and IPv6 addresses of the given interfaces.
+// Interfaces that do not exist are skipped.
+func interfaceIPs(l log.Logger, ifaces []string) []net.IP {
+	var ips []net.IP
+	for _, iface := range ifaces {
+		li, err := netlink.LinkByName(iface)
+		if err != nil {
+			continue
+		}
+		addrs, err := netlink.AddrList(li, netlink.FAMILY_ALL)
+		if err != nil {
+			level.Warn(l).Log("msg", "failed to list addresses", "interface", iface, "error", err.Error())
+			continue
+		}
+		for _, a := range addrs {
+			// Link-local addresses cannot be used without a zone, so skip them.
+			if a.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, a.IP)
+		}
+	}
+	return ips
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,306 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// offlinePresetPath is the preset file in which units enabled or disabled offline are recorded,
+	// so that presets applied on first boot do not undo them.
+	// Preset files are applied in lexicographic order and the first match wins,
+	// so this file must sort before any other presets.
+	offlinePresetPath = "/etc/systemd/system-preset/10-onboard-offline.preset"
+	// systemdSystemPath is the directory containing the administrator's units and their wants and requires directories.
+	systemdSystemPath = "/etc/systemd/system"
+	// maxSymlinks is the maximum number of symlinks that are followed when resolving a path.
+	maxSymlinks = 40
+)
+
+// systemdUnitPaths are the directories in which unit files are searched, in order of precedence.
+var systemdUnitPaths = []string{systemdSystemPath, "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// errSkipOffline is returned by offline actions that can only be performed on a running system.
+var errSkipOffline = errors.New("action can only be performed on a running system")
+
+// offlineAction returns a function that performs the action against the filesystem rooted at root
+// rather than against the running system.
+func (a *Action) offlineAction(root string) func(context.Context, map[string]string, io.Writer) error {
+	if a.File != nil {
+		return a.File.offlineAction(root)
+	}
+	if a.Systemd != nil {
+		return a.Systemd.offlineAction(root)
+	}
+	if a.Certificate != nil || a.Power != nil {
+		// Keys must be generated on the device itself, so that every device
+		// flashed from the same image does not share them,
+		// and an image cannot be rebooted.
+		return func(_ context.Context, _ map[string]string, _ io.Writer) error {
+			return errSkipOffline
+		}
+	}
+	return nil
+}
+
+func (f *FileAction) offlineAction(root string) func(context.Context, map[string]string, io.Writer) error {
+	return func(ctx context.Context, values map[string]string, out io.Writer) error {
+		// The path is resolved when the action runs, since earlier actions may have created links in it.
+		resolved, err := resolveInRoot(root, f.Path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve file %q: %w", f.Path, err)
+		}
+		path := filepath.Join(root, resolved)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for file %q: %w", path, err)
+		}
+		return f.actionAt(path)(ctx, values, out)
+	}
+}
+
+func (s *SystemdAction) offlineAction(root string) func(context.Context, map[string]string, io.Writer) error {
+	return func(_ context.Context, _ map[string]string, _ io.Writer) error {
+		switch s.Command {
+		case SystemdCommandEnable:
+			if err := enableOffline(root, s.Unit); err != nil {
+				return err
+			}
+			return setPresetOffline(root, s.Unit, "enable")
+		case SystemdCommandDisable:
+			if err := disableOffline(root, s.Unit); err != nil {
+				return err
+			}
+			return setPresetOffline(root, s.Unit, "disable")
+		}
+		return errSkipOffline
+	}
+}
+
+// resolveInRoot resolves all symlinks in every element of the given path,
+// interpreting absolute symlink targets relative to root, and returns the resolved path relative to root.
+// Elements that do not exist yet are kept as they are, so that the path can be created.
+// Paths and symlinks that leave the root are refused.
+func resolveInRoot(root, path string) (string, error) {
+	var resolved []string
+	pending := strings.Split(filepath.ToSlash(path), "/")
+	for links := 0; len(pending) > 0; {
+		e := pending[0]
+		pending = pending[1:]
+		switch e {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("path %q leaves the root", path)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		p := filepath.Join(root, filepath.Join(resolved...), e)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = append(resolved, e)
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, e)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %q", path)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return "/" + filepath.Join(resolved...), nil
+}
+
+// findUnitOffline returns the path of the file for the given unit inside of root,
+// falling back to the template for instantiated units.
+func findUnitOffline(root, unit string) (string, error) {
+	names := []string{unit}
+	if i := strings.Index(unit, "@"); i >= 0 {
+		names = append(names, unit[:i+1]+filepath.Ext(unit))
+	}
+	for _, name := range names {
+		for _, dir := range systemdUnitPaths {
+			path := filepath.Join(dir, name)
+			// Directories such as /lib are often absolute symlinks in the image.
+			resolved, err := resolveInRoot(root, path)
+			if err != nil {
+				return "", fmt.Errorf("failed to resolve unit %q: %w", unit, err)
+			}
+			if _, err := os.Lstat(filepath.Join(root, resolved)); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unit %q was not found", unit)
+}
+
+// installTargets parses the [Install] section of a unit file and returns
+// the wants and requires directories in which the unit should be linked.
+func installTargets(unitFile []byte) []string {
+	var dirs []string
+	var install bool
+	s := bufio.NewScanner(bytes.NewReader(unitFile))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			install = line == "[Install]"
+			continue
+		}
+		if !install {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var suffix string
+		switch strings.TrimSpace(parts[0]) {
+		case "WantedBy":
+			suffix = ".wants"
+		case "RequiredBy":
+			suffix = ".requires"
+		default:
+			continue
+		}
+		for _, target := range strings.Fields(parts[1]) {
+			dirs = append(dirs, target+suffix)
+		}
+	}
+	return dirs
+}
+
+// enableOffline creates the symlinks that `systemctl enable` would create for the given unit.
+func enableOffline(root, unit string) error {
+	path, err := findUnitOffline(root, unit)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveInRoot(root, path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve unit %q: %w", unit, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, resolved))
+	if err != nil {
+		return fmt.Errorf("failed to read unit %q: %w", unit, err)
+	}
+	dirs := installTargets(data)
+	if len(dirs) == 0 {
+		return fmt.Errorf("unit %q has no [Install] section and cannot be enabled", unit)
+	}
+	for _, dir := range dirs {
+		resolved, err := resolveInRoot(root, filepath.Join(systemdSystemPath, dir))
+		if err != nil {
+			return fmt.Errorf("failed to resolve directory %q: %w", dir, err)
+		}
+		d := filepath.Join(root, resolved)
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %q: %w", d, err)
+		}
+		link := filepath.Join(d, unit)
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove existing link %q: %w", link, err)
+		}
+		if err := os.Symlink(path, link); err != nil {
+			return fmt.Errorf("failed to link unit %q: %w", unit, err)
+		}
+	}
+	return nil
+}
+
+// disableOffline removes all of the wants and requires symlinks for the given unit.
+func disableOffline(root, unit string) error {
+	dir, err := resolveInRoot(root, systemdSystemPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve directory %q: %w", systemdSystemPath, err)
+	}
+	for _, pattern := range []string{"*.wants", "*.requires"} {
+		links, err := filepath.Glob(filepath.Join(root, dir, pattern, unit))
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if err := os.Remove(link); err != nil {
+				return fmt.Errorf("failed to remove link %q: %w", link, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setPresetOffline records the given preset for the unit, replacing any previous preset for it.
+func setPresetOffline(root, unit, preset string) error {
+	resolved, err := resolveInRoot(root, offlinePresetPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve preset file: %w", err)
+	}
+	path := filepath.Join(root, resolved)
+	var lines []string
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read preset file: %w", err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) >= 2 && fields[1] == unit {
+			continue
+		}
+		lines = append(lines, s.Text())
+	}
+	lines = append(lines, fmt.Sprintf("%s %s", preset, unit))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create preset directory: %w", err)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// applyOffline runs the configured actions against the filesystem rooted at root.
+// Checks are skipped, since they can only be run on a running system.
+func applyOffline(root string, cfg *config, values map[string]string) error {
+	for _, a := range cfg.Actions {
+		if err := a.offlineAction(root)(context.Background(), values, ioutil.Discard); err != nil {
+			if err == errSkipOffline {
+				fmt.Fprintf(os.Stdout, "[skipped] %s: %v\n", a.Name, err)
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "[failed] %s\n", a.Name)
+			return fmt.Errorf("action %q failed: %w", a.Name, err)
+		}
+		fmt.Fprintf(os.Stdout, "[ok] %s\n", a.Name)
+	}
+	return nil
+}
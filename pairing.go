@@ -0,0 +1,77 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// pairingPINContext binds the PIN to its purpose, so that the secret can be reused for other derivations.
+const pairingPINContext = "onboard pairing PIN"
+
+type pairingConfig struct {
+	// secretFile is the path to the secret from which the PIN is derived.
+	// Pairing is disabled if it is empty.
+	secretFile string
+	// pinFile is an optional path at which the PIN is written, e.g. on the boot partition.
+	pinFile    string
+	sessionTTL time.Duration
+}
+
+// loadOrCreatePairingSecret reads the pairing secret at the given path,
+// generating and saving a new secret if none exists.
+func loadOrCreatePairingSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("pairing secret file %q is empty", path)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read pairing secret file %q: %w", path, err)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate pairing secret: %w", err)
+	}
+	secret := []byte(hex.EncodeToString(buf))
+	if err := writeFile(path, append(secret, '\n'), 0600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// pairingPIN derives an eight-digit PIN from the secret.
+// The digits are extracted with the dynamic truncation from RFC 4226,
+// so that a label printer that knows the secret can compute the same PIN.
+func pairingPIN(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pairingPINContext))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%08d", code%100000000)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	provisioningMinBackoff = time.Second
+	provisioningMaxBackoff = 30 * time.Second
+)
+
+// errNotProvisioned is returned when the provisioning server has no values for the device.
+var errNotProvisioned = errors.New("device is not known to the provisioning server")
+
+type provisioningConfig struct {
+	url       string
+	tokenFile string
+	certFile  string
+	keyFile   string
+	caFile    string
+	// timeout is how long to keep trying to reach the provisioning server
+	// before falling back to the wizard.
+	timeout time.Duration
+}
+
+// provisioner fetches values for a device from a provisioning server.
+type provisioner struct {
+	url   string
+	token string
+	c     *http.Client
+}
+
+// newProvisioner creates a provisioner from the given configuration,
+// reading the bearer token and TLS credentials from disk.
+func newProvisioner(cfg provisioningConfig) (*provisioner, error) {
+	p := &provisioner{url: strings.TrimSuffix(cfg.url, "/")}
+	if cfg.tokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read provisioning token: %w", err)
+		}
+		p.token = strings.TrimSpace(string(token))
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.certFile != "" || cfg.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load provisioning client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.caFile != "" {
+		ca, err := ioutil.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read provisioning CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse provisioning CA %q", cfg.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	p.c = &http.Client{Transport: transport, Timeout: provisioningMaxBackoff}
+	return p, nil
+}
+
+// values fetches the values for the device with the given ID.
+// If the server does not know the device, then errNotProvisioned is returned.
+func (p *provisioner) values(ctx context.Context, id string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/devices/%s", p.url, url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errNotProvisioned
+	default:
+		return nil, fmt.Errorf("provisioning server responded with %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	values, err := parseValues(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse values: %w", err)
+	}
+	return values, nil
+}
+
+// provision fetches the values for the device from the provisioning server and onboards the device with them.
+// The server is retried with exponential backoff until the context is done,
+// in which case the device falls back to being onboarded via the wizard.
+func provision(ctx context.Context, l log.Logger, p *provisioner, id string, cfg *config, h http.Handler) error {
+	var values map[string]string
+	var err error
+	backoff := provisioningMinBackoff
+	for {
+		values, err = p.values(ctx, id)
+		if err == nil {
+			break
+		}
+		if err == errNotProvisioned {
+			level.Info(l).Log("msg", "device is not provisioned; falling back to the wizard", "id", id)
+			return nil
+		}
+		level.Debug(l).Log("msg", "failed to reach provisioning server", "error", err.Error())
+		select {
+		case <-ctx.Done():
+			level.Warn(l).Log("msg", "provisioning server is unreachable; falling back to the wizard", "error", err.Error())
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > provisioningMaxBackoff {
+			backoff = provisioningMaxBackoff
+		}
+	}
+
+	level.Info(l).Log("msg", "onboarding with values from provisioning server")
+	var report bytes.Buffer
+	c := &client{endpoint: "http://onboard", c: &http.Client{Transport: handlerTransport{h}}}
+	if err := submitValues(&report, c, cfg, values, headlessCheckTries, headlessInterval); err != nil {
+		level.Debug(l).Log("msg", "provisioning report", "report", report.String())
+		return fmt.Errorf("failed to onboard with values from provisioning server: %w", err)
+	}
+	level.Info(l).Log("msg", "onboarded with values from provisioning server")
+	return nil
+}
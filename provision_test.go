@@ -0,0 +1,176 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	v1 "github.com/squat/onboard/api/v1"
+)
+
+// testDevice is an onboard API backed by a configuration that writes
+// the value "hostname" to a file in a temporary directory.
+type testDevice struct {
+	cfg *config
+	h   http.Handler
+	// path is the file that is written when the device is onboarded.
+	path string
+}
+
+func newTestDevice(t *testing.T) *testDevice {
+	t.Helper()
+	dir := t.TempDir()
+	d := &testDevice{cfg: &config{}, path: filepath.Join(dir, "hostname")}
+	data := []byte(`
+values:
+- name: hostname
+  description: Hostname
+actions:
+- name: hostname
+  file:
+    path: ` + d.path + `
+    value: hostname
+`)
+	if err := yaml.Unmarshal(data, d.cfg); err != nil {
+		t.Fatalf("failed to parse configuration: %v", err)
+	}
+	if err := d.cfg.validate(); err != nil {
+		t.Fatalf("configuration is invalid: %v", err)
+	}
+	actions := make([]v1.Action, 0, len(d.cfg.Actions))
+	for _, a := range d.cfg.Actions {
+		actions = append(actions, v1.Action{Name: a.Name, Run: a.action(nil)})
+	}
+	// The network checks that follow onboarding query the wireless interface,
+	// which the test host does not have, so the link is always reported as connected.
+	o, err := v1.NewOnboarding(log.NewNopLogger(), v1.OnboardingOptions{Actions: actions, StatePath: filepath.Join(dir, "state.json")})
+	if err != nil {
+		t.Fatalf("failed to create onboarding: %v", err)
+	}
+	m := http.NewServeMux()
+	m.Handle("/", v1.New(prometheus.NewRegistry(), log.NewNopLogger(), "", []byte("{}"), o, nil, nil))
+	m.HandleFunc("/api/v1/status/link", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"addresses": ["192.0.2.2/24"], "state": "up"}`))
+	})
+	d.h = m
+	return d
+}
+
+func newTestProvisioner(t *testing.T, url, token string) *provisioner {
+	t.Helper()
+	cfg := provisioningConfig{url: url}
+	if token != "" {
+		cfg.tokenFile = filepath.Join(t.TempDir(), "token")
+		if err := ioutil.WriteFile(cfg.tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatalf("failed to write token: %v", err)
+		}
+	}
+	p, err := newProvisioner(cfg)
+	if err != nil {
+		t.Fatalf("failed to create provisioner: %v", err)
+	}
+	return p
+}
+
+func TestProvision(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		timeout time.Duration
+		// minRequests is the least number of requests the server should receive.
+		minRequests int32
+		// retried is whether the server should be retried until the timeout.
+		retried   bool
+		onboarded bool
+	}{
+		{
+			name:        "values",
+			status:      http.StatusOK,
+			body:        `{"hostname": "pi"}`,
+			timeout:     time.Minute,
+			minRequests: 1,
+			onboarded:   true,
+		},
+		{
+			name:        "not found",
+			status:      http.StatusNotFound,
+			timeout:     time.Minute,
+			minRequests: 1,
+		},
+		{
+			name:    "server error",
+			status:  http.StatusServiceUnavailable,
+			timeout: 1500 * time.Millisecond,
+			// The server is tried immediately and again after the minimum backoff.
+			minRequests: 2,
+			retried:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if r.URL.Path != "/devices/abc" {
+					http.NotFound(w, r)
+					return
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("expected bearer token to be sent; got Authorization %q", got)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer s.Close()
+			d := newTestDevice(t)
+			p := newTestProvisioner(t, s.URL+"/", "secret")
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			start := time.Now()
+			if err := provision(ctx, log.NewNopLogger(), p, "abc", d.cfg, d.h); err != nil {
+				t.Fatalf("expected no error; got %v", err)
+			}
+			if n := atomic.LoadInt32(&requests); n < tc.minRequests {
+				t.Errorf("expected at least %d requests; got %d", tc.minRequests, n)
+			}
+			if tc.retried && time.Since(start) < tc.timeout {
+				t.Errorf("expected to retry until the timeout of %s; gave up after %s", tc.timeout, time.Since(start))
+			}
+			data, err := ioutil.ReadFile(d.path)
+			switch {
+			case tc.onboarded && err != nil:
+				t.Errorf("expected device to be onboarded: %v", err)
+			case tc.onboarded && string(data) != "pi":
+				t.Errorf("expected file to contain %q; got %q", "pi", string(data))
+			case !tc.onboarded && !os.IsNotExist(err):
+				t.Errorf("expected device not to be onboarded; got error %v", err)
+			}
+		})
+	}
+}
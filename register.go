@@ -0,0 +1,337 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	v1 "github.com/squat/onboard/api/v1"
+	"github.com/squat/onboard/version"
+)
+
+const (
+	registerMinBackoff = time.Second
+	registerMaxBackoff = 5 * time.Minute
+	// registrationStatePath is where the registration and its status are persisted,
+	// so that registration resumes after a reboot.
+	registrationStatePath = "/var/lib/onboard/registration.json"
+	// boardModelPath contains the model of the board on devices with a device tree.
+	boardModelPath = "/proc/device-tree/model"
+)
+
+// registration is the body that is POSTed to the fleet backend.
+type registration struct {
+	ID        string            `json:"id"`
+	Hostname  string            `json:"hostname"`
+	Addresses []string          `json:"addresses"`
+	Version   string            `json:"version"`
+	Model     string            `json:"model,omitempty"`
+	Values    map[string]string `json:"values"`
+	// PublicKey is the base64-encoded Ed25519 public key with which the registration is signed.
+	PublicKey string `json:"publicKey"`
+	// Timestamp is set on every attempt so that the backend can reject replayed requests.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// registrationState is persisted to disk.
+type registrationState struct {
+	Status       v1.RegistrationStatus `json:"status"`
+	Registration *registration         `json:"registration,omitempty"`
+}
+
+// registrar registers the device with a fleet backend after it has been onboarded.
+// It implements the v1.Registrar interface.
+type registrar struct {
+	l     log.Logger
+	url   string
+	id    string
+	ident *identity
+	cfg   *config
+	c     *http.Client
+	// h is the API against which the checks are run before registering.
+	h http.Handler
+
+	// ctx is canceled when the registrar stops.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu    sync.Mutex
+	state registrationState
+	// cancel cancels the registration that is in progress, if any.
+	cancel context.CancelFunc
+}
+
+// newRegistrar creates a registrar that signs registrations with the device's identity.
+// Any registration that was persisted before a restart is loaded.
+func newRegistrar(l log.Logger, id string, cfg *config, ident *identity) (*registrar, error) {
+	r := &registrar{
+		l:     l,
+		url:   cfg.Register.URL,
+		id:    id,
+		ident: ident,
+		cfg:   cfg,
+		c:     &http.Client{Timeout: 30 * time.Second},
+		state: registrationState{Status: v1.RegistrationStatus{State: v1.RegistrationStatePending}},
+	}
+	r.ctx, r.stop = context.WithCancel(context.Background())
+	data, err := ioutil.ReadFile(registrationStatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read registration state: %w", err)
+		}
+		return r, nil
+	}
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		level.Warn(l).Log("msg", "ignoring invalid registration state", "error", err.Error())
+		r.state = registrationState{Status: v1.RegistrationStatus{State: v1.RegistrationStatePending}}
+	}
+	return r, nil
+}
+
+// Status implements the v1.Registrar interface.
+func (r *registrar) Status() v1.RegistrationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.Status
+}
+
+// Register implements the v1.Registrar interface.
+// Any registration that is in progress is abandoned in favor of the new values.
+// The registration is persisted before the checks run, so that it resumes
+// even if a deferred action reboots the device first.
+func (r *registrar) Register(values map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx := r.restart()
+	reg := r.newRegistration(values)
+	r.state = registrationState{Status: v1.RegistrationStatus{State: v1.RegistrationStatePending}, Registration: reg}
+	r.persist()
+	go r.checkAndRegister(ctx, reg, values)
+}
+
+// Run resumes any registration that was interrupted by a restart
+// and blocks until the context is done.
+func (r *registrar) Run(ctx context.Context) error {
+	r.mu.Lock()
+	if reg := r.state.Registration; reg != nil {
+		switch r.state.Status.State {
+		case v1.RegistrationStatePending:
+			// Secret values are not persisted, so checks that refer to them
+			// are run without them.
+			level.Info(r.l).Log("msg", "resuming registration after checks")
+			go r.checkAndRegister(r.restart(), reg, reg.Values)
+		case v1.RegistrationStateRegistering:
+			level.Info(r.l).Log("msg", "resuming registration")
+			go r.register(r.restart(), reg)
+		}
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	r.stop()
+	return nil
+}
+
+// checkAndRegister runs the checks with the given values and registers the device once they pass.
+func (r *registrar) checkAndRegister(ctx context.Context, reg *registration, values map[string]string) {
+	var report bytes.Buffer
+	c := &client{endpoint: "http://onboard", c: &http.Client{Transport: handlerTransport{r.h}}}
+	if err := runChecks(&report, c, clientChecks(r.cfg, values), headlessCheckTries, headlessInterval); err != nil {
+		level.Warn(r.l).Log("msg", "not registering device because checks failed", "error", err.Error())
+		return
+	}
+	r.register(ctx, reg)
+}
+
+// restart cancels the registration that is in progress, if any,
+// and returns the context for a new one. It must be called with the lock held.
+func (r *registrar) restart() context.Context {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(r.ctx)
+	return ctx
+}
+
+// newRegistration builds the registration for the device.
+// Secret values are never included.
+func (r *registrar) newRegistration(values map[string]string) *registration {
+	reg := &registration{
+		ID:        r.id,
+		Version:   version.Version,
+		Values:    make(map[string]string),
+		PublicKey: base64.StdEncoding.EncodeToString(r.ident.publicKey()),
+	}
+	for _, v := range r.cfg.Values {
+		if !v.Secret {
+			reg.Values[v.Name] = values[v.Name]
+		}
+	}
+	return reg
+}
+
+// describeHost sets the details of the host on the registration.
+// They are gathered right before registering, since the actions and a reboot may change them.
+func (r *registrar) describeHost(reg *registration) {
+	reg.Model = boardModel()
+	var err error
+	if reg.Hostname, err = os.Hostname(); err != nil {
+		level.Warn(r.l).Log("msg", "failed to get hostname", "error", err.Error())
+	}
+	if reg.Addresses, err = hostAddresses(); err != nil {
+		level.Warn(r.l).Log("msg", "failed to get addresses", "error", err.Error())
+	}
+}
+
+// register POSTs the registration to the backend, retrying with exponential backoff
+// until it is accepted or the context is done.
+func (r *registrar) register(ctx context.Context, reg *registration) {
+	r.describeHost(reg)
+	backoff := registerMinBackoff
+	for {
+		r.mu.Lock()
+		// A newer registration may have replaced this one.
+		if ctx.Err() != nil {
+			r.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		r.state.Registration = reg
+		r.state.Status.State = v1.RegistrationStateRegistering
+		r.state.Status.Attempts++
+		r.state.Status.LastAttempt = &now
+		r.persist()
+		r.mu.Unlock()
+
+		err := r.post(ctx, reg)
+
+		r.mu.Lock()
+		if ctx.Err() != nil {
+			r.mu.Unlock()
+			return
+		}
+		if err == nil {
+			now := time.Now()
+			r.state.Status.State = v1.RegistrationStateRegistered
+			r.state.Status.Error = ""
+			r.state.Status.RegisteredAt = &now
+			r.state.Registration = nil
+			r.persist()
+			r.mu.Unlock()
+			level.Info(r.l).Log("msg", "registered device", "url", r.url)
+			return
+		}
+		r.state.Status.Error = err.Error()
+		r.persist()
+		r.mu.Unlock()
+		level.Warn(r.l).Log("msg", "failed to register device", "error", err.Error(), "retry", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > registerMaxBackoff {
+			backoff = registerMaxBackoff
+		}
+	}
+}
+
+// post signs and sends a single registration attempt.
+func (r *registrar) post(ctx context.Context, reg *registration) error {
+	reg.Timestamp = time.Now().UTC()
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, r.ident.sign(body))
+	res, err := r.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("registration endpoint responded with %s", res.Status)
+	}
+	return nil
+}
+
+// persist writes the state to disk. It must be called with the lock held.
+func (r *registrar) persist() {
+	buf, err := json.Marshal(r.state)
+	if err != nil {
+		level.Error(r.l).Log("msg", "failed to marshal registration state", "error", err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(registrationStatePath), 0755); err != nil {
+		level.Error(r.l).Log("msg", "failed to create directory for registration state", "error", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(registrationStatePath, buf, 0600); err != nil {
+		level.Error(r.l).Log("msg", "failed to write registration state", "error", err.Error())
+	}
+}
+
+// boardModel returns the model of the board, or an empty string if it is unknown.
+func boardModel() string {
+	data, err := ioutil.ReadFile(boardModelPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+}
+
+// hostAddresses returns all routable addresses of the host.
+func hostAddresses() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("host has no routable addresses")
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	v1 "github.com/squat/onboard/api/v1"
+)
+
+const (
+	// onboardingStatePath is where the onboarding state is persisted.
+	onboardingStatePath = "/var/lib/onboard/state.json"
+	// doneFilesPath lists files that must exist for the device to be considered onboarded.
+	doneFilesPath = "/etc/onboard/done-files"
+	// networkStatePath is written by the ping service with the state of the network.
+	networkStatePath = "/var/lib/onboard/network"
+)
+
+// legacyOnboardingState determines the state of a device for which no onboarding state was persisted,
+// e.g. because it was onboarded by an older version of Onboard.
+// It mirrors the logic that the hostapd-manager service uses to decide whether or not to disable the access point:
+// the device is onboarded once all done files exist and the network is up.
+func legacyOnboardingState() v1.OnboardingState {
+	network, err := ioutil.ReadFile(networkStatePath)
+	if err != nil || strings.TrimSpace(string(network)) != "up" {
+		return v1.OnboardingStateUnonboarded
+	}
+	doneFiles, err := ioutil.ReadFile(doneFilesPath)
+	if err != nil {
+		return v1.OnboardingStateUnonboarded
+	}
+	s := bufio.NewScanner(bytes.NewReader(doneFiles))
+	for s.Scan() {
+		df := s.Text()
+		if df == "" {
+			continue
+		}
+		if _, err := os.Stat(df); err != nil {
+			return v1.OnboardingStateUnonboarded
+		}
+	}
+	return v1.OnboardingStateOnboarded
+}
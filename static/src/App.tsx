@@ -1,4 +1,4 @@
-import React, { useState, Dispatch, SetStateAction } from 'react';
+import React, { useEffect, useRef, useState, Dispatch, SetStateAction } from 'react';
 import {
     TransitionGroup,
     CSSTransition
@@ -6,13 +6,16 @@ import {
 import {
     Switch,
     Route,
+    useHistory,
     useLocation
 } from "react-router-dom";
 import './App.css';
 import './fonts.css';
 import {CustomStep, Form, Step, Submit, Text} from './Form';
 import {Check, CheckGroup, TrueCheck, retryCheck} from './Check';
-import client, {isError, Configuration, SystemdResult, SystemdSubState} from './api';
+import client, {isError, Configuration, SystemdResult, SystemdSubState, Value, ValueType} from './api';
+import {encryptValue} from './encrypt';
+import {validateValue} from './validate';
 
 declare global { interface Window { configuration: Configuration; } };
 
@@ -20,49 +23,107 @@ type StatePair<T> = [T, Dispatch<SetStateAction<T>>];
 
 const App: React.FunctionComponent = () => {
     let location = useLocation();
+    let history = useHistory();
     const c = window.configuration;
+    // If the device requires pairing, the PIN is collected in a step before the values.
+    const pairing: Value[] = c.pairing ? [{name: "pair", description: "Pairing PIN", secret: true, required: true}] : [];
+    // Computed values are derived by the device, so they have no step.
+    const values = c.values.filter(v => !v.computed);
+    const fields = [...pairing, ...values];
+    // Inputs are prefilled with their defaults, and booleans must always be either true or false.
+    const initial = fields.map(v => c.defaults?.[v.name] ?? (v.type === ValueType.Bool ? "false" : ""));
     const states: StatePair<string>[] = []; 
-    for (let i = 0; i < c.values.length; i++) {
+    for (let i = 0; i < fields.length; i++) {
         // eslint-disable-next-line react-hooks/rules-of-hooks
-        states.push(useState(""));
+        states.push(useState(initial[i]));
     };
+    // When the device is onboarded again, inputs are prefilled with the current values.
+    // Inputs that the user has already changed are kept.
+    // This fails silently if the device requires pairing and the browser has no session yet.
+    const prefill = () => client.currentValues().then(r => {
+        if (isError(r)) {
+            return;
+        }
+        fields.forEach((v, i) => {
+            const value = r.values[v.name];
+            if (value !== undefined && v.type !== ValueType.File) {
+                states[i][1](prev => prev === initial[i] ? value : prev);
+            }
+        });
+    }).catch(() => {});
+    useEffect(() => {
+        prefill();
+        // The values are read when the webapp is loaded and again once the browser has paired.
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, []);
+    // files are the files chosen for file values by name.
+    const [files, setFiles] = useState<{[name: string]: File | undefined}>({});
+    // submitError is the error with which the device rejected the values.
+    // If it names a value, then it is shown on that value's step.
+    const [submitError, setSubmitError] = useState<{error: string, value?: string, fields?: {[name: string]: string}}>();
+    // If the device requires pairing, the browser pairs as soon as the user moves on from the PIN's step,
+    // so that the current values can be read. A wrong PIN is reported on its step.
+    const previousPath = useRef(location.pathname);
+    useEffect(() => {
+        const movedOn = c.pairing && fields.length > 1 && previousPath.current === "/" + fields[0].name && location.pathname === "/" + fields[1].name;
+        previousPath.current = location.pathname;
+        if (!movedOn) {
+            return;
+        }
+        client.pair(states[0][0]).then(r => {
+            if (isError(r)) {
+                throw new Error(r.error);
+            }
+            setSubmitError(e => e?.value === fields[0].name ? undefined : e);
+            prefill();
+        }).catch(e => {
+            setSubmitError({error: e.message, value: fields[0].name});
+            history.push("/" + fields[0].name);
+        });
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [location.pathname]);
     let firstStep = "/submit";
     let lastStep = "/";
-    const steps = c.values.map((v, i) => {
+    const steps = fields.map((v, i) => {
         if (i === 0) {
             firstStep = "/" + v.name;
         }
-        if (i === c.values.length - 1) {
+        if (i === fields.length - 1) {
             lastStep = "/" + v.name;
         }
         let back = "/";
         if (i > 0) {
-            back = "/" + c.values[i-1].name;
+            back = "/" + fields[i-1].name;
         }
         let next = "/submit";
-        if (i < c.values.length - 1) {
-            next = "/" + c.values[i+1].name;
+        if (i < fields.length - 1) {
+            next = "/" + fields[i+1].name;
         }
         return <Route path={"/" + v.name}>
-            <Step value={states[i][0]} back={back} next={next} setState={states[i][1]} placeholder={v.description} password={v.secret} />
+            <Step v={v} value={states[i][0]} back={back} next={next} setState={states[i][1]} setFile={f => setFiles({...files, [v.name]: f})} error={submitError?.fields?.[v.name] ?? (submitError?.value === v.name ? submitError.error : undefined)} invalid={validateValue(v, states[i][0], files[v.name])} />
         </Route>;
     });
+    const [job, setJob] = useState("");
     let checks: React.ReactElement[] = [];
     c.checks.forEach((ch, i) => {
         if (!ch) {
             return;
         }
         if (ch.dns) {
-            for (let j = 0; j < c.values.length; j++) {
-                if (ch.dns.value === c.values[j].name) {
-                    checks.push(<Check name="Testing DNS" check={retryCheck(() => {return client.dns(states[j][0]).then(r => {return !isError(r)})})} />);
+            for (let j = 0; j < values.length; j++) {
+                if (ch.dns.value === values[j].name) {
+                    const state = states[j + pairing.length];
+                    checks.push(<Check name="Testing DNS" check={retryCheck(() => {return client.dns(state[0]).then(r => {return !isError(r)})})} />);
                 }
             }
         } else if (ch.systemd) {
             checks.push(<Check name={ch.systemd.description} check={retryCheck(() => {return client.systemd(ch.systemd!.unit).then(r => {return !isError(r) && r.result === SystemdResult.Success && r.subState === SystemdSubState.Dead})}, 10)} />);
         }
     });
+    // Every action is reported as it finishes, before the checks are run.
+    const actions = c.actions.map(a => <Check name={a.name} check={() => client.action(job, a.name)} />);
     checks = [
+        ...actions,
         <Check name="Bringing Up Network" check={retryCheck(() => {return client.link().then(r => {
             console.log(isError(r));
             return !isError(r) && r.state === "up";
@@ -81,15 +142,47 @@ const App: React.FunctionComponent = () => {
     const [submitOK, setSubmitOK] = useState(false);
     const submit = (): void => {
         setInFlight(true);
-        const state = new Map<string, string>();
-        c.values.forEach((v, i) => {
-            state.set(v.name, states[i][0]);
+        setSubmitError(undefined);
+        // Files are uploaded as is, except for secret files, which are read and encrypted like any other secret.
+        const entries = Promise.all(values.map(async (v, i): Promise<[string, string | File]> => {
+            let value: string | File = states[i + pairing.length][0];
+            if (v.type === ValueType.File) {
+                const file = files[v.name];
+                value = file && v.secret ? await file.text() : (file || "");
+            }
+            if (typeof value === "string" && v.secret && c.encryptionKey) {
+                value = encryptValue(c.encryptionKey, value);
+            }
+            return [v.name, value];
+        }));
+        // Values are submitted as a multipart form if any of them can be a file.
+        const request = entries.then(entries => {
+            if (!values.some(v => v.type === ValueType.File)) {
+                return JSON.stringify(Object.fromEntries(entries));
+            }
+            const form = new FormData();
+            entries.forEach(([name, value]) => form.append(name, value));
+            return form;
         });
-        client.onboard(JSON.stringify(Object.fromEntries(state.entries()))).then(r => {
+        const paired = c.pairing ? client.pair(states[0][0]).then(r => {
+            if (isError(r)) {
+                throw new Error(r.error);
+            }
+        }) : Promise.resolve();
+        paired.then(() => request).then(r => client.onboard(r)).then(r => {
+            if (!isError(r)) {
+                setJob(r.job);
+            } else {
+                setSubmitError(r);
+                if (r.value) {
+                    history.push("/" + r.value);
+                }
+            }
             setSubmited(true)
             setSubmitOK(!isError(r));
             setInFlight(false);
         }).catch((e) => {
+            setSubmitError({error: e.message});
             setSubmited(true)
             setSubmitOK(false);
             setInFlight(false);
@@ -122,7 +215,7 @@ const App: React.FunctionComponent = () => {
                                      timeout={300}
                                     >
                                         <div style={{display: "flex", justifyContent: "center"}}>
-                                            {(!submitted || !submitOK) && <Submit inFlight={inFlight} ok={submitOK} submitted={submitted} />}
+                                            {(!submitted || !submitOK) && <Submit inFlight={inFlight} ok={submitOK} submitted={submitted} error={submitError?.value ? undefined : submitError?.error} />}
                                             {(submitted && submitOK) && <CheckGroup>
                                                 {checks}
                                             </CheckGroup>}
@@ -135,6 +228,9 @@ const App: React.FunctionComponent = () => {
                 </CSSTransition>
             </TransitionGroup>
         </Form>
+        {(location.pathname === "/" && c.tlsFingerprint) && <p className="fingerprint">
+            Certificate fingerprint (SHA-256):<br />{c.tlsFingerprint}
+        </p>}
     </div>
 };
 
@@ -1,4 +1,4 @@
-import React from 'react';
+import React, {useEffect, useState} from 'react';
 import {
     Link,
     NavLink,
@@ -7,6 +7,7 @@ import {
 
 import './Form.css';
 import Status from './Status';
+import client, {isError, Value, ValueType} from './api';
 
 interface FormProps {
     inFlight: boolean
@@ -34,11 +35,18 @@ interface TextProps {
 
 interface StepProps {
     back: string
+    // error is shown below the input, e.g. if the device rejected the value.
+    error?: string
+    // invalid is why the value does not satisfy its constraints, if it does not.
+    // The step cannot be completed until the value is valid.
+    invalid?: string
     next: string
-    placeholder: string
-    password?: boolean
+    // setFile is called with the chosen file of file values.
+    setFile?(file?: File): void
     setState(value: string): void
     value: string
+    // v is the value that is collected by the step and determines the type of the input.
+    v: Value
 }
 
 interface CustomStepProps {
@@ -48,6 +56,7 @@ interface CustomStepProps {
 }
 
 interface SubmitProps {
+    error?: string
     ok: boolean
     inFlight: boolean
     submitted: boolean
@@ -57,33 +66,98 @@ export const Text: React.FunctionComponent<TextProps>= ({label, to}) => <div cla
     <Link to={to}>{label} <span className="arrow">&rarr;</span></Link>
 </div>
 
-export const Step: React.FunctionComponent<StepProps> = ({back, next, placeholder, password, setState, value}) => {
+export const Step: React.FunctionComponent<StepProps> = ({back, error, invalid, next, setFile, setState, v, value}) => {
     let history = useHistory();
-    const onKeyPress = (e: React.KeyboardEvent<HTMLInputElement>) => {
-        if (e.key === "Enter") {
+    const onKeyPress = (e: React.KeyboardEvent<HTMLElement>) => {
+        // Multiline text is completed with Ctrl+Enter, since Enter starts a new line.
+        if (e.key === "Enter" && (v.type !== ValueType.Multiline || e.ctrlKey || e.metaKey)) {
             e.stopPropagation();
             e.preventDefault();
-            if (value) {
+            if (!invalid) {
                 history.push(next);
             }
         }
     };
-    const onChange = (e: React.ChangeEvent<HTMLInputElement>) => setState(e.target.value);
+    const onChange = (e: React.ChangeEvent<HTMLInputElement | HTMLSelectElement | HTMLTextAreaElement>) => setState(e.target.value);
+    const onFileChange = (e: React.ChangeEvent<HTMLInputElement>) => {
+        const file = e.target.files?.[0];
+        setFile?.(file);
+        setState(file ? file.name : "");
+    };
+    // The options of a select are listed by the device whenever the step is shown, if they are dynamic.
+    const [options, setOptions] = useState(v.options || []);
+    const [optionsError, setOptionsError] = useState<string>();
+    useEffect(() => {
+        if (v.type !== ValueType.Select || !v.optionsFrom) {
+            return;
+        }
+        client.options(v.name).then(r => {
+            if (isError(r)) {
+                setOptionsError(r.error);
+                return;
+            }
+            setOptions(r.options);
+        }).catch(e => setOptionsError(e.message));
+    }, [v]);
+    // An empty required value is not reported until the user types something.
+    const message = (value && invalid) || error || optionsError;
+    let input: React.ReactElement;
+    switch (v.type) {
+        case ValueType.Bool:
+            input = <select autoFocus onChange={onChange} onKeyPress={onKeyPress} value={value}>
+                <option value="true">Yes: {v.description}</option>
+                <option value="false">No: {v.description}</option>
+            </select>;
+            break;
+        case ValueType.Select:
+            input = <select autoFocus onChange={onChange} onKeyPress={onKeyPress} value={value}>
+                <option value="" disabled={v.required}>{v.description}</option>
+                { options.map(o => <option key={o} value={o}>{o}</option>) }
+            </select>;
+            break;
+        case ValueType.Multiline:
+            input = <textarea
+                autoFocus
+                placeholder={v.description}
+                onChange={onChange}
+                onKeyPress={onKeyPress}
+                value={value}
+                rows={4}
+                autoComplete="off"
+                autoCorrect="off"
+                autoCapitalize="off"
+                spellCheck="false"
+            />;
+            break;
+        case ValueType.File:
+            // The input is hidden behind a label that shows the name of the chosen file.
+            input = <label className="step-file">
+                {value || v.description}
+                <input type="file" autoFocus accept={v.contentTypes?.join(",")} onChange={onFileChange} onKeyPress={onKeyPress} />
+            </label>;
+            break;
+        default:
+            input = <input
+                type={v.secret ? "password" : "text"}
+                inputMode={v.type === ValueType.Int ? "numeric" : undefined}
+                autoFocus
+                placeholder={v.description}
+                onChange={onChange}
+                onKeyPress={onKeyPress}
+                value={value}
+                autoComplete="off"
+                autoCorrect="off"
+                autoCapitalize="off"
+                spellCheck="false"
+            />;
+    }
     return <div className="step">
         <Link to={back}>&larr;</Link> 
-        <input
-            type={password ? "password" : "text"}
-            autoFocus
-            placeholder={placeholder}
-            onChange={onChange}
-            onKeyPress={onKeyPress}
-            value={value}
-            autoComplete="off"
-            autoCorrect="off"
-            autoCapitalize="off"
-            spellCheck="false"
-        />
-        { value && <Link to={next}>&rarr;</Link> }
+        <div className="step-input">
+            {input}
+            { message && <span className="step-error">{message}</span> }
+        </div>
+        { !invalid && <Link to={next}>&rarr;</Link> }
     </div>;
 }
 
@@ -93,9 +167,10 @@ export const CustomStep: React.FunctionComponent<CustomStepProps> = ({back, chil
     { next && showNext && <NavLink style={{right: 0, position: "absolute"}} to={next}>&rarr;</NavLink> }
 </div>
 
-export const Submit: React.FunctionComponent<SubmitProps> = ({inFlight, ok, submitted}) => <div style={{display: "flex"}}>
+export const Submit: React.FunctionComponent<SubmitProps> = ({error, inFlight, ok, submitted}) => <div className="step-input" style={{display: "flex"}}>
     <input autoFocus type="submit" value="Submit" />
     <Status done={submitted} inFlight={inFlight} ok={ok} />
+    { error && <span className="step-error">{error}</span> }
 </div>
 
 export default Form;
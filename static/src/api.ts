@@ -1,10 +1,22 @@
+import {EncryptionKey} from './encrypt';
+
 export const isError = (r: any | ErrorResponse): r is ErrorResponse => {
     return (r as ErrorResponse).error !== undefined;
 };
 
 export interface Configuration {
+    actions: Action[]
     checks: Check[]
     values: Value[]
+    encryptionKey?: EncryptionKey
+    tlsFingerprint?: string
+    pairing?: boolean
+    // defaults are the default values by name, with which inputs are prefilled.
+    defaults?: {[name: string]: string}
+};
+
+interface Action {
+    name: string
 };
 
 interface Check {
@@ -23,14 +35,48 @@ interface SystemdCheck {
     description: string
 };
 
-interface Value {
+export enum ValueType {
+    String = "string",
+    Bool = "bool",
+    Int = "int",
+    Select = "select",
+    Multiline = "multiline",
+    File = "file",
+}
+
+export interface Value {
     name: string
     description: string
     secret: boolean
+    type?: ValueType
+    // options are the allowed values of a select.
+    options?: string[]
+    // optionsFrom is set if the options of a select are listed by the device when they are requested.
+    optionsFrom?: object
+    // maxSize is the maximum size of a file in bytes.
+    maxSize?: number
+    // contentTypes are the allowed media types of a file, e.g. text/plain or image/*.
+    contentTypes?: string[]
+    required?: boolean
+    // pattern is a regular expression that must match the entire value.
+    pattern?: string
+    minLength?: number
+    maxLength?: number
+    enum?: string[]
+    // message is shown instead of the default message when the value is invalid.
+    message?: string
+    // computed values are derived by the device and are not collected.
+    computed?: string
 };
 
 interface ErrorResponse {
     error: string
+    code?: string
+    // value is the name of the submitted value that caused the error, if any.
+    value?: string
+    // fields maps the names of all of the submitted values that caused the error to their errors.
+    fields?: {[name: string]: string}
+    job?: string
 };
 
 interface DNSResponse {
@@ -56,23 +102,134 @@ interface LogEntry {
     __REALTIME_TIMESTAMP: string
 };
 
+interface WirelessResponse {
+    ssid: string
+    bssid: string
+    frequency: number
+    channel: number
+    signal: number
+    txBitrate: number
+    rxBitrate: number
+};
+
+interface LeaseResponse {
+    address: string
+    netmask: string
+    router?: string
+    server?: string
+    dns?: string[]
+    domain?: string
+    lifetime?: number
+};
+
 interface LinkResponse {
     addresses: string[]
     state: string
+    gateway?: string
+    wireless?: WirelessResponse
+    lease?: LeaseResponse
 };
 
 interface OnboardResponse {
+    job: string
+};
+
+interface OptionsResponse {
+    options: string[]
+};
+
+interface CurrentValuesResponse {
+    values: {[name: string]: string}
+    // errors maps the names of the values whose current value could not be read to their errors.
+    errors?: {[name: string]: string}
+};
+
+export enum ActionState {
+    Pending = "pending",
+    Running = "running",
+    Succeeded = "succeeded",
+    Failed = "failed",
+    Skipped = "skipped",
+}
+
+interface ActionStatus {
+    name: string
+    state: ActionState
+    deferred?: boolean
+    duration?: number
+    error?: string
+    output?: string
+};
+
+export enum JobState {
+    Running = "running",
+    Succeeded = "succeeded",
+    Failed = "failed",
+}
+
+interface Job {
+    id: string
+    state: JobState
+    started: string
+    finished?: string
+    error?: string
+    actions: ActionStatus[]
+};
+
+interface PairResponse {
+    token: string
+    expires: string
 };
 
 interface Client {
+    action(job: string, name: string): Promise<boolean>
+    currentValues(): Promise<CurrentValuesResponse|ErrorResponse>
     dns(endpoint: string): Promise<DNSResponse|ErrorResponse>
     link(): Promise<LinkResponse|ErrorResponse>
     log(name: string, append: (logs: LogEntry[]) => void): () => void
-    onboard(request: string): Promise<OnboardResponse|ErrorResponse>
+    onboard(request: string | FormData): Promise<OnboardResponse|ErrorResponse>
+    options(name: string): Promise<OptionsResponse|ErrorResponse>
+    pair(pin: string): Promise<PairResponse|ErrorResponse>
     systemd(unit: string): Promise<SystemdResponse|ErrorResponse>
 };
 
 export const client: Client = {
+    action: (job: string, name: string): Promise<boolean> => {
+        return new Promise((resolve, reject) => {
+            const es = new EventSource("/api/v1/jobs/" + job + "/events");
+            es.onmessage = (e: MessageEvent): void => {
+                const j = JSON.parse(e.data as string) as Job;
+                const a = j.actions.find(a => a.name === name);
+                if (a === undefined) {
+                    es.close();
+                    reject(new Error("action not found"));
+                    return;
+                }
+                // Deferred actions only run once the job has finished and the stream has ended,
+                // so they are done as far as the client is concerned once they are scheduled.
+                if (a.deferred && a.state === ActionState.Pending && j.state === JobState.Succeeded) {
+                    es.close();
+                    resolve(true);
+                    return;
+                }
+                switch (a.state) {
+                    case ActionState.Pending:
+                    case ActionState.Running:
+                        return;
+                    case ActionState.Succeeded:
+                        resolve(true);
+                        break;
+                    case ActionState.Failed:
+                        reject(new Error(a.error));
+                        break;
+                    case ActionState.Skipped:
+                        reject(new Error("skipped"));
+                        break;
+                }
+                es.close();
+            };
+        });
+    },
     dns: (endpoint: string): Promise<DNSResponse|ErrorResponse> => {
         return fetch("/api/v1/status/dns?" + new URLSearchParams({endpoint})).then(r => {
             if (r.ok) {
@@ -99,6 +256,11 @@ export const client: Client = {
             });
         });
     },
+    currentValues: (): Promise<CurrentValuesResponse|ErrorResponse> => {
+        return fetch("/api/v1/values/current").then(r => {
+            return r.json().then((rr: CurrentValuesResponse|ErrorResponse) => rr);
+        });
+    },
     link: (): Promise<LinkResponse|ErrorResponse> => {
         return fetch("/api/v1/status/link").then(r => {
             return r.json().then((rr: LinkResponse|ErrorResponse) => {
@@ -119,18 +281,43 @@ export const client: Client = {
         }
         return es.close
     },
-    onboard: (request: string): Promise<OnboardResponse|ErrorResponse> => {
+    onboard: (request: string | FormData): Promise<OnboardResponse|ErrorResponse> => {
+        // Forms with files are submitted as multipart forms, whose content type is set by the browser.
         return fetch("/api/v1/onboard", {
+            method: "POST",
+            headers: typeof request === "string" ? {
+              "Content-Type": "application/json"
+            } : undefined,
+            body: request
+          }).then(r => {
+            return r.json().then((rr: OnboardResponse|ErrorResponse) => {
+                if (r.ok) {
+                    return rr;
+                }
+                if (Math.floor(r.status) === 4) {
+                    throw new Error((rr as ErrorResponse).error);
+                }
+                return rr;
+            });
+        });
+    },
+    options: (name: string): Promise<OptionsResponse|ErrorResponse> => {
+        return fetch("/api/v1/values/options/" + encodeURIComponent(name)).then(r => {
+            return r.json().then((rr: OptionsResponse|ErrorResponse) => rr);
+        });
+    },
+    pair: (pin: string): Promise<PairResponse|ErrorResponse> => {
+        return fetch("/api/v1/pair", {
             method: "POST",
             headers: {
               "Content-Type": "application/json"
             },
-            body: request
+            body: JSON.stringify({pin})
           }).then(r => {
-            if (r.ok) {
-                return {};
-            }
-            return r.json().then((rr: ErrorResponse) => {
+            return r.json().then((rr: PairResponse|ErrorResponse) => {
+                if (r.ok) {
+                    return rr;
+                }
                 if (Math.floor(r.status) === 4) {
                     throw new Error((rr as ErrorResponse).error);
                 }
@@ -0,0 +1,40 @@
+// Secret values are encrypted with RSA-OAEP using SHA-256 before they are submitted,
+// since the onboarding access point is open and the webapp is served over plain HTTP.
+// WebCrypto is not available to pages served over plain HTTP, so node-forge is used instead.
+import forge from "node-forge";
+
+export interface EncryptionKey {
+    kty: string
+    alg: string
+    n: string
+    e: string
+};
+
+// fromBase64URL decodes an unpadded base64url-encoded big-endian integer, as found in a JSON Web Key.
+const fromBase64URL = (s: string): forge.jsbn.BigInteger => {
+    let b64 = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (b64.length % 4 !== 0) {
+        b64 += "=";
+    }
+    return new forge.jsbn.BigInteger(forge.util.bytesToHex(forge.util.decode64(b64)), 16);
+};
+
+// encryptValue encrypts the value with the given key in the format that the API expects:
+// the value is split into chunks that fit into a single RSA-OAEP message,
+// which are encrypted individually, base64-encoded, and joined with periods.
+export const encryptValue = (key: EncryptionKey, value: string): string => {
+    const pub = forge.pki.setRsaPublicKey(fromBase64URL(key.n), fromBase64URL(key.e));
+    const max = Math.ceil(pub.n.bitLength() / 8) - 2 * 32 - 2;
+    const data = forge.util.encodeUtf8(value);
+    const chunks: string[] = [];
+    let offset = 0;
+    do {
+        const chunk = data.substring(offset, offset + max);
+        chunks.push(forge.util.encode64(pub.encrypt(chunk, "RSA-OAEP", {
+            md: forge.md.sha256.create(),
+            mgf1: {md: forge.md.sha256.create()},
+        })));
+        offset += max;
+    } while (offset < data.length);
+    return chunks.join(".");
+};
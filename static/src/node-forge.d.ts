@@ -0,0 +1,32 @@
+// node-forge does not ship type definitions; these cover the parts that the webapp uses.
+declare module "node-forge" {
+    namespace forge {
+        namespace jsbn {
+            class BigInteger {
+                constructor(value: string, radix: number);
+                bitLength(): number;
+            }
+        }
+        namespace md {
+            interface MessageDigest {}
+            namespace sha256 {
+                function create(): MessageDigest;
+            }
+        }
+        namespace pki {
+            interface PublicKey {
+                n: jsbn.BigInteger;
+                e: jsbn.BigInteger;
+                encrypt(data: string, scheme: "RSA-OAEP", options: {md: md.MessageDigest, mgf1: {md: md.MessageDigest}}): string;
+            }
+            function setRsaPublicKey(n: jsbn.BigInteger, e: jsbn.BigInteger): PublicKey;
+        }
+        namespace util {
+            function bytesToHex(bytes: string): string;
+            function decode64(encoded: string): string;
+            function encode64(bytes: string): string;
+            function encodeUtf8(s: string): string;
+        }
+    }
+    export default forge;
+}
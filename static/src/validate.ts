@@ -0,0 +1,71 @@
+import {Value, ValueType} from './api';
+
+// allows returns whether the media type of a file is one of the given types, e.g. text/plain or image/*.
+const allows = (contentTypes: string[], type: string): boolean => contentTypes.some(ct => {
+    return ct === type || ct === "*/*" || (ct.endsWith("/*") && type.startsWith(ct.slice(0, -1)));
+});
+
+// validateValue checks the given input against the value's constraints
+// in the same way as the device and returns why it is invalid, if it is.
+// The input of a file value is the name of the chosen file, which is also given.
+export const validateValue = (v: Value, s: string, file?: File): string | undefined => {
+    const invalid = (msg: string) => v.message || msg;
+    if (!s) {
+        return v.required ? invalid("is required") : undefined;
+    }
+    switch (v.type) {
+        case ValueType.Bool:
+            if (s !== "true" && s !== "false") {
+                return invalid("must be true or false");
+            }
+            break;
+        case ValueType.Int:
+            if (!/^[+-]?[0-9]+$/.test(s)) {
+                return invalid("must be an integer");
+            }
+            break;
+        case ValueType.Select:
+            // Dynamic options are only checked by the device.
+            if (!v.optionsFrom && !(v.options || []).includes(s)) {
+                return invalid(`must be one of ${(v.options || []).map(o => `"${o}"`).join(", ")}`);
+            }
+            break;
+        case ValueType.File:
+            if (!file) {
+                return undefined;
+            }
+            if (v.maxSize && file.size > v.maxSize) {
+                return invalid(`must be at most ${v.maxSize} bytes`);
+            }
+            // Files without a type are binary data.
+            if (v.contentTypes && v.contentTypes.length > 0 && !allows(v.contentTypes, file.type || "application/octet-stream")) {
+                return invalid(`must be a file of type ${v.contentTypes.join(", ")}`);
+            }
+            // The remaining constraints apply to the contents of the file, which are only checked by the device.
+            return undefined;
+    }
+    // Lengths are counted in characters rather than UTF-16 code units.
+    const n = Array.from(s).length;
+    if (v.minLength && n < v.minLength) {
+        return invalid(`must be at least ${v.minLength} characters long`);
+    }
+    if (v.maxLength && n > v.maxLength) {
+        return invalid(`must be at most ${v.maxLength} characters long`);
+    }
+    if (v.pattern) {
+        let re: RegExp;
+        try {
+            re = new RegExp(`^(?:${v.pattern})$`);
+        } catch {
+            // Patterns that are not valid in JavaScript are only enforced by the device.
+            return undefined;
+        }
+        if (!re.test(s)) {
+            return invalid(`must match pattern "${v.pattern}"`);
+        }
+    }
+    if (v.enum && v.enum.length > 0 && !v.enum.includes(s)) {
+        return invalid(`must be one of ${v.enum.map(e => `"${e}"`).join(", ")}`);
+    }
+    return undefined;
+};
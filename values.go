@@ -0,0 +1,245 @@
+// Copyright 2021 the Onboard authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/squat/onboard/api/v1"
+)
+
+const (
+	// currentValueTimeout is how long reading the current value of a value may take.
+	currentValueTimeout = 5 * time.Second
+	// optionsTimeout is how long listing the options of a select may take.
+	optionsTimeout = 5 * time.Second
+	// optionsCacheTTL is how long listed options, or the failure to list them, are reused before they are listed again.
+	optionsCacheTTL = time.Minute
+)
+
+// CurrentValue configures how the current value of a value is read from the system,
+// so that clients can prefill inputs when a device is onboarded again.
+type CurrentValue struct {
+	// File is the path to a file whose contents are the current value.
+	// This field is mutually exclusive with `Command`.
+	File string `json:"file,omitempty"`
+	// Pattern is a regular expression that is matched against the contents of the file.
+	// The current value is the first submatch, or the entire match if the pattern has no submatches.
+	Pattern string `json:"pattern,omitempty"`
+	// Command is a command whose output is the current value.
+	// This field is mutually exclusive with `File`.
+	Command []string `json:"command,omitempty"`
+	re      *regexp.Regexp
+}
+
+func (c *CurrentValue) validate() error {
+	var errs []string
+	if (c.File == "") == (len(c.Command) == 0) {
+		errs = append(errs, "exactly one of 'file' or 'command' must be specified")
+	}
+	if c.Pattern != "" {
+		if c.File == "" {
+			errs = append(errs, "a pattern can only be matched against a file")
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("pattern is invalid: %v", err))
+		} else {
+			c.re = re
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// read reads the current value. Surrounding whitespace is trimmed.
+func (c *CurrentValue) read(ctx context.Context) (string, error) {
+	if len(c.Command) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, currentValueTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run command: %w", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	data, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	if c.re == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	m := c.re.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("file %q does not match pattern %q", c.File, c.Pattern)
+	}
+	if len(m) > 1 {
+		return strings.TrimSpace(string(m[1])), nil
+	}
+	return strings.TrimSpace(string(m[0])), nil
+}
+
+// currentValues reads the current values of the values that declare how to, except for secret values.
+// Values that cannot be read are reported as errors, but the others are returned nonetheless.
+func (c *config) currentValues(ctx context.Context) (map[string]string, error) {
+	values := make(map[string]string)
+	var errs v1.ValueErrors
+	for _, v := range c.Values {
+		if v.Current == nil || v.Secret {
+			continue
+		}
+		s, err := v.Current.read(ctx)
+		if err != nil {
+			errs = append(errs, &v1.ValueError{Name: v.Name, Err: err})
+			continue
+		}
+		values[v.Name] = s
+	}
+	if len(errs) > 0 {
+		return values, errs
+	}
+	return values, nil
+}
+
+// OptionsSource configures how the options of a select are listed on the device when they are requested,
+// e.g. the available serial ports or time zones.
+type OptionsSource struct {
+	// Glob is a pattern whose matching paths are the options.
+	Glob string `json:"glob,omitempty"`
+	// File is the path to a file whose non-empty lines are the options.
+	File string `json:"file,omitempty"`
+	// Command is a command whose non-empty lines of output are the options.
+	Command []string `json:"command,omitempty"`
+	// TrimPrefix is removed from the beginning of every option, e.g. the directory of a glob.
+	TrimPrefix string `json:"trimPrefix,omitempty"`
+	// cache is nil unless options can be listed.
+	cache *optionsCache
+}
+
+// optionsCache caches the options that were listed most recently, or the error with which listing them failed.
+type optionsCache struct {
+	mu      sync.Mutex
+	options []string
+	err     error
+	expires time.Time
+}
+
+func (o *OptionsSource) validate() error {
+	n := 0
+	if o.Glob != "" {
+		n++
+		if _, err := filepath.Match(o.Glob, ""); err != nil {
+			return fmt.Errorf("glob %q is invalid: %w", o.Glob, err)
+		}
+	}
+	if o.File != "" {
+		n++
+	}
+	if len(o.Command) > 0 {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of 'glob', 'file', or 'command' must be specified")
+	}
+	return nil
+}
+
+// list returns the options, which are listed again once the cached ones have expired.
+// Failures are cached as well, so that clients cannot make the device list the options more often.
+// Concurrent calls wait for the options to be listed only once.
+func (o *OptionsSource) list(ctx context.Context) ([]string, error) {
+	if o.cache == nil {
+		return nil, errors.New("options cannot be listed")
+	}
+	o.cache.mu.Lock()
+	defer o.cache.mu.Unlock()
+	if time.Now().Before(o.cache.expires) {
+		return o.cache.options, o.cache.err
+	}
+	o.cache.options, o.cache.err = o.listUncached(ctx)
+	o.cache.expires = time.Now().Add(optionsCacheTTL)
+	return o.cache.options, o.cache.err
+}
+
+// listUncached lists the options.
+func (o *OptionsSource) listUncached(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, optionsTimeout)
+	defer cancel()
+	var lines []string
+	switch {
+	case o.Glob != "":
+		matches, err := filepath.Glob(o.Glob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find matches for glob %q: %w", o.Glob, err)
+		}
+		lines = matches
+	case o.File != "":
+		data, err := ioutil.ReadFile(o.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		lines = strings.Split(string(data), "\n")
+	default:
+		out, err := exec.CommandContext(ctx, o.Command[0], o.Command[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run command: %w", err)
+		}
+		lines = strings.Split(string(out), "\n")
+	}
+	options := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if l = strings.TrimPrefix(strings.TrimSpace(l), o.TrimPrefix); l != "" {
+			options = append(options, l)
+		}
+	}
+	return options, nil
+}
+
+// initOptions allows the dynamic options of selects to be listed.
+// It must only be called on the device itself; until it is called, e.g. when the configuration is applied
+// to an image or was fetched from a device, submitted values are not checked against dynamic options.
+func (c *config) initOptions() {
+	for _, v := range c.Values {
+		if v.OptionsFrom != nil {
+			v.OptionsFrom.cache = &optionsCache{}
+		}
+	}
+}
+
+// options lists the dynamic options of the select with the given name.
+func (c *config) options(ctx context.Context, name string) ([]string, error) {
+	for _, v := range c.Values {
+		if v.Name == name && v.OptionsFrom != nil {
+			options, err := v.OptionsFrom.list(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list options of value %q: %w", name, err)
+			}
+			return options, nil
+		}
+	}
+	return nil, &v1.ValueError{Name: name, Err: errors.New("does not have dynamic options")}
+}